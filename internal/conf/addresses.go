@@ -0,0 +1,30 @@
+package conf
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Addresses is a parameter that contains a list of listen addresses.
+type Addresses []string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Addresses) UnmarshalJSON(b []byte) error {
+	var in []string
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+
+	if len(in) == 0 {
+		return nil
+	}
+
+	*d = in
+
+	return nil
+}
+
+func (d *Addresses) unmarshalEnv(s string) error {
+	byts, _ := json.Marshal(strings.Split(s, ","))
+	return d.UnmarshalJSON(byts)
+}
@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"reflect"
+	"regexp"
 	"strings"
 	"time"
 
@@ -18,6 +20,8 @@ import (
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
+var reConnIDPrefix = regexp.MustCompile(`^[0-9a-zA-Z_\-\.]*$`)
+
 func decrypt(key string, byts []byte) ([]byte, error) {
 	enc, err := base64.StdEncoding.DecodeString(string(byts))
 	if err != nil {
@@ -169,6 +173,7 @@ func loadFromFile(fpath string, conf *Conf) (bool, error) {
 type Conf struct {
 	// general
 	LogLevel                  LogLevel        `json:"logLevel"`
+	LogFormat                 LogFormat       `json:"logFormat"`
 	LogDestinations           LogDestinations `json:"logDestinations"`
 	LogFile                   string          `json:"logFile"`
 	ReadTimeout               StringDuration  `json:"readTimeout"`
@@ -183,6 +188,7 @@ type Conf struct {
 	PPROFAddress              string          `json:"pprofAddress"`
 	RunOnConnect              string          `json:"runOnConnect"`
 	RunOnConnectRestart       bool            `json:"runOnConnectRestart"`
+	RunOnDisconnect           string          `json:"runOnDisconnect"`
 
 	// RTSP
 	RTSPDisable       bool        `json:"rtspDisable"`
@@ -200,12 +206,47 @@ type Conf struct {
 	AuthMethods       AuthMethods `json:"authMethods"`
 
 	// RTMP
-	RTMPDisable    bool       `json:"rtmpDisable"`
-	RTMPAddress    string     `json:"rtmpAddress"`
-	RTMPEncryption Encryption `json:"rtmpEncryption"`
-	RTMPSAddress   string     `json:"rtmpsAddress"`
-	RTMPServerKey  string     `json:"rtmpServerKey"`
-	RTMPServerCert string     `json:"rtmpServerCert"`
+	RTMPDisable              bool           `json:"rtmpDisable"`
+	RTMPAddress              string         `json:"rtmpAddress"`
+	RTMPAdditionalAddresses  Addresses      `json:"rtmpAdditionalAddresses"`
+	RTMPNetwork              string         `json:"rtmpNetwork"`
+	RTMPReusePort            bool           `json:"rtmpReusePort"`
+	RTMPListenBacklog        int            `json:"rtmpListenBacklog"`
+	RTMPListenRetries        int            `json:"rtmpListenRetries"`
+	RTMPListenRetryInterval  StringDuration `json:"rtmpListenRetryInterval"`
+	RTMPSkipOnListenError    bool           `json:"rtmpSkipOnListenError"`
+	RTMPTCPReadBufferSize    int            `json:"rtmpTCPReadBufferSize"`
+	RTMPTCPWriteBufferSize   int            `json:"rtmpTCPWriteBufferSize"`
+	RTMPTCPNoDelayDisable    bool           `json:"rtmpTCPNoDelayDisable"`
+	RTMPTCPLinger            StringDuration `json:"rtmpTCPLinger"`
+	RTMPProxyProtocol        bool           `json:"rtmpProxyProtocol"`
+	RTMPEncryption           Encryption     `json:"rtmpEncryption"`
+	RTMPSAddress             string         `json:"rtmpsAddress"`
+	RTMPSAdditionalAddresses Addresses      `json:"rtmpsAdditionalAddresses"`
+	RTMPServerKey            string         `json:"rtmpServerKey"`
+	RTMPServerCert           string         `json:"rtmpServerCert"`
+	RTMPMaxConns             int            `json:"rtmpMaxConns"`
+	RTMPConnRateLimit        int            `json:"rtmpConnRateLimit"`
+	RTMPConnRateWindow       StringDuration `json:"rtmpConnRateWindow"`
+	RTMPAllowedNets          IPsOrCIDRs     `json:"rtmpAllowedNets"`
+	RTMPDeniedNets           IPsOrCIDRs     `json:"rtmpDeniedNets"`
+	RTMPAllowedPaths         PathPatterns   `json:"rtmpAllowedPaths"`
+	RTMPConnIDFormat         ConnIDFormat   `json:"rtmpConnIDFormat"`
+	RTMPConnIDPrefix         string         `json:"rtmpConnIDPrefix"`
+	RTMPHandshakeTimeout     StringDuration `json:"rtmpHandshakeTimeout"`
+	RTMPWriteChunkSize       int            `json:"rtmpWriteChunkSize"`
+	RTMPConnLogDisable       bool           `json:"rtmpConnLogDisable"`
+	RTMPReadWaitPublisher    StringDuration `json:"rtmpReadWaitPublisher"`
+	RTMPReaderKeepalive      StringDuration `json:"rtmpReaderKeepalive"`
+	RTMPIdleTimeout          StringDuration `json:"rtmpIdleTimeout"`
+	RTMPSlowWriteThreshold   StringDuration `json:"rtmpSlowWriteThreshold"`
+	RTMPSlowReaderKickAfter  StringDuration `json:"rtmpSlowReaderKickAfter"`
+	RTMPShutdownGracePeriod  StringDuration `json:"rtmpShutdownGracePeriod"`
+	RTMPHandoffURL           string         `json:"rtmpHandoffURL"`
+	RTMPPublishTokenURL      string         `json:"rtmpPublishTokenURL"`
+	RTMPRunOnPublish         string         `json:"rtmpRunOnPublish"`
+	RTMPRunOnUnpublish       string         `json:"rtmpRunOnUnpublish"`
+	RTMPPublishHookDebounce  StringDuration `json:"rtmpPublishHookDebounce"`
 
 	// HLS
 	HLSDisable         bool           `json:"hlsDisable"`
@@ -362,6 +403,119 @@ func (conf *Conf) CheckAndFillMissing() error {
 		conf.RTMPSAddress = ":1936"
 	}
 
+	switch conf.RTMPNetwork {
+	case "":
+		conf.RTMPNetwork = "tcp"
+
+	case "tcp", "tcp4", "tcp6":
+
+	default:
+		return fmt.Errorf("invalid 'rtmpNetwork': '%s'", conf.RTMPNetwork)
+	}
+
+	if conf.RTMPListenBacklog < 0 {
+		return fmt.Errorf("'rtmpListenBacklog' can't be negative")
+	}
+
+	if conf.RTMPListenRetries < 0 {
+		return fmt.Errorf("'rtmpListenRetries' can't be negative")
+	}
+
+	if conf.RTMPListenRetryInterval == 0 {
+		conf.RTMPListenRetryInterval = StringDuration(time.Second)
+	}
+
+	if conf.RTMPTCPReadBufferSize < 0 {
+		return fmt.Errorf("'rtmpTCPReadBufferSize' can't be negative")
+	}
+
+	if conf.RTMPTCPWriteBufferSize < 0 {
+		return fmt.Errorf("'rtmpTCPWriteBufferSize' can't be negative")
+	}
+
+	if conf.RTMPTCPLinger < 0 {
+		return fmt.Errorf("'rtmpTCPLinger' can't be negative")
+	}
+
+	if conf.RTMPTCPLinger != 0 && conf.RTMPTCPLinger < StringDuration(time.Second) {
+		return fmt.Errorf("'rtmpTCPLinger' must be at least 1s")
+	}
+
+	if conf.RTMPMaxConns < 0 {
+		return fmt.Errorf("'rtmpMaxConns' can't be negative")
+	}
+
+	if conf.RTMPConnRateLimit < 0 {
+		return fmt.Errorf("'rtmpConnRateLimit' can't be negative")
+	}
+
+	if conf.RTMPConnRateWindow < 0 {
+		return fmt.Errorf("'rtmpConnRateWindow' can't be negative")
+	}
+	if conf.RTMPConnRateWindow == 0 {
+		conf.RTMPConnRateWindow = 10 * StringDuration(time.Second)
+	}
+
+	if len(conf.RTMPConnIDPrefix) > 64 {
+		return fmt.Errorf("'rtmpConnIDPrefix' can't be longer than 64 characters")
+	}
+	if !reConnIDPrefix.MatchString(conf.RTMPConnIDPrefix) {
+		return fmt.Errorf("'rtmpConnIDPrefix' can contain only alphanumeric characters, underscore, dot or minus")
+	}
+
+	if conf.RTMPHandshakeTimeout < 0 {
+		return fmt.Errorf("'rtmpHandshakeTimeout' can't be negative")
+	}
+
+	if conf.RTMPWriteChunkSize == 0 {
+		conf.RTMPWriteChunkSize = 65536
+	}
+	if conf.RTMPWriteChunkSize < 128 || conf.RTMPWriteChunkSize > 0xFFFFFF {
+		return fmt.Errorf("'rtmpWriteChunkSize' must be between 128 and 16777215")
+	}
+
+	if conf.RTMPReadWaitPublisher < 0 {
+		return fmt.Errorf("'rtmpReadWaitPublisher' can't be negative")
+	}
+
+	if conf.RTMPReaderKeepalive < 0 {
+		return fmt.Errorf("'rtmpReaderKeepalive' can't be negative")
+	}
+
+	if conf.RTMPIdleTimeout < 0 {
+		return fmt.Errorf("'rtmpIdleTimeout' can't be negative")
+	}
+
+	if conf.RTMPSlowWriteThreshold < 0 {
+		return fmt.Errorf("'rtmpSlowWriteThreshold' can't be negative")
+	}
+
+	if conf.RTMPSlowReaderKickAfter < 0 {
+		return fmt.Errorf("'rtmpSlowReaderKickAfter' can't be negative")
+	}
+
+	if conf.RTMPShutdownGracePeriod < 0 {
+		return fmt.Errorf("'rtmpShutdownGracePeriod' can't be negative")
+	}
+
+	if conf.RTMPHandoffURL != "" {
+		u, err := url.Parse(conf.RTMPHandoffURL)
+		if err != nil || (u.Scheme != "rtmp" && u.Scheme != "rtmps") || u.Host == "" {
+			return fmt.Errorf("'rtmpHandoffURL' must be a RTMP URL")
+		}
+	}
+
+	if conf.RTMPPublishTokenURL != "" {
+		if !strings.HasPrefix(conf.RTMPPublishTokenURL, "http://") &&
+			!strings.HasPrefix(conf.RTMPPublishTokenURL, "https://") {
+			return fmt.Errorf("'rtmpPublishTokenURL' must be a HTTP URL")
+		}
+	}
+
+	if conf.RTMPPublishHookDebounce < 0 {
+		return fmt.Errorf("'rtmpPublishHookDebounce' can't be negative")
+	}
+
 	if conf.HLSAddress == "" {
 		conf.HLSAddress = ":8888"
 	}
@@ -192,3 +192,13 @@ func TestConfErrorNonExistentParameter(t *testing.T) {
 		require.EqualError(t, err, "parameter paths, key mypath: non-existent parameter: 'invalid'")
 	}()
 }
+
+func TestConfErrorNegativeRTMPConnRateWindow(t *testing.T) {
+	tmpf, err := writeTempFile([]byte("rtmpConnRateLimit: 5\n" +
+		"rtmpConnRateWindow: -1s\n"))
+	require.NoError(t, err)
+	defer os.Remove(tmpf)
+
+	_, _, err = Load(tmpf)
+	require.EqualError(t, err, "'rtmpConnRateWindow' can't be negative")
+}
@@ -0,0 +1,62 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ConnIDFormat is the format of connection IDs.
+type ConnIDFormat int
+
+// supported connection ID formats.
+const (
+	ConnIDFormatDecimal ConnIDFormat = iota
+	ConnIDFormatUUID
+	ConnIDFormatHex
+)
+
+// MarshalJSON implements json.Marshaler.
+func (d ConnIDFormat) MarshalJSON() ([]byte, error) {
+	var out string
+
+	switch d {
+	case ConnIDFormatUUID:
+		out = "uuid"
+
+	case ConnIDFormatHex:
+		out = "hex"
+
+	default:
+		out = "decimal"
+	}
+
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *ConnIDFormat) UnmarshalJSON(b []byte) error {
+	var in string
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+
+	switch in {
+	case "decimal":
+		*d = ConnIDFormatDecimal
+
+	case "uuid":
+		*d = ConnIDFormatUUID
+
+	case "hex":
+		*d = ConnIDFormatHex
+
+	default:
+		return fmt.Errorf("invalid connection ID format: '%s'", in)
+	}
+
+	return nil
+}
+
+func (d *ConnIDFormat) unmarshalEnv(s string) error {
+	return d.UnmarshalJSON([]byte(`"` + s + `"`))
+}
@@ -0,0 +1,56 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// OnDemandPolicy decides what happens when a publisher connects to a path
+// whose runOnDemand command is already running.
+type OnDemandPolicy int
+
+// supported on-demand policies.
+const (
+	OnDemandPolicyPublisher OnDemandPolicy = iota
+	OnDemandPolicyOnDemand
+)
+
+// MarshalJSON implements json.Marshaler.
+func (d OnDemandPolicy) MarshalJSON() ([]byte, error) {
+	var out string
+
+	switch d {
+	case OnDemandPolicyOnDemand:
+		out = "onDemand"
+
+	default:
+		out = "publisher"
+	}
+
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *OnDemandPolicy) UnmarshalJSON(b []byte) error {
+	var in string
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+
+	switch in {
+	case "publisher":
+		*d = OnDemandPolicyPublisher
+
+	case "onDemand":
+		*d = OnDemandPolicyOnDemand
+
+	default:
+		return fmt.Errorf("invalid on-demand policy: '%s'", in)
+	}
+
+	return nil
+}
+
+func (d *OnDemandPolicy) unmarshalEnv(s string) error {
+	return d.UnmarshalJSON([]byte(`"` + s + `"`))
+}
@@ -49,6 +49,9 @@ type PathConf struct {
 	SourceRedirect             string         `json:"sourceRedirect"`
 	DisablePublisherOverride   bool           `json:"disablePublisherOverride"`
 	Fallback                   string         `json:"fallback"`
+	RTMPMaxReaders             int            `json:"rtmpMaxReaders"`
+	RTMPMaxPublishBitrate      int            `json:"rtmpMaxPublishBitrate"`
+	RTMPFallbackFile           string         `json:"rtmpFallbackFile"`
 	RPICameraCamID             int            `json:"rpiCameraCamID"`
 	RPICameraWidth             int            `json:"rpiCameraWidth"`
 	RPICameraHeight            int            `json:"rpiCameraHeight"`
@@ -73,6 +76,7 @@ type PathConf struct {
 	RunOnDemandRestart      bool           `json:"runOnDemandRestart"`
 	RunOnDemandStartTimeout StringDuration `json:"runOnDemandStartTimeout"`
 	RunOnDemandCloseAfter   StringDuration `json:"runOnDemandCloseAfter"`
+	RunOnDemandPolicy       OnDemandPolicy `json:"runOnDemandPolicy"`
 	RunOnReady              string         `json:"runOnReady"`
 	RunOnReadyRestart       bool           `json:"runOnReadyRestart"`
 	RunOnRead               string         `json:"runOnRead"`
@@ -226,6 +230,18 @@ func (pconf *PathConf) checkAndFillMissing(conf *Conf, name string) error {
 		}
 	}
 
+	if pconf.RTMPMaxReaders < 0 {
+		return fmt.Errorf("'rtmpMaxReaders' can't be negative")
+	}
+
+	if pconf.RTMPMaxPublishBitrate < 0 {
+		return fmt.Errorf("'rtmpMaxPublishBitrate' can't be negative")
+	}
+
+	if pconf.RTMPFallbackFile != "" && pconf.Source != "publisher" {
+		return fmt.Errorf("'rtmpFallbackFile' can be used only when source is 'publisher'")
+	}
+
 	if (pconf.PublishUser != "" && pconf.PublishPass == "") ||
 		(pconf.PublishUser == "" && pconf.PublishPass != "") {
 		return fmt.Errorf("read username and password must be both filled")
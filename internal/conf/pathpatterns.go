@@ -0,0 +1,38 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// PathPatterns is a parameter that contains a list of path names or glob patterns.
+type PathPatterns []string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *PathPatterns) UnmarshalJSON(b []byte) error {
+	var in []string
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+
+	if len(in) == 0 {
+		return nil
+	}
+
+	for _, t := range in {
+		if _, err := path.Match(t, ""); err != nil {
+			return fmt.Errorf("invalid path pattern '%s'", t)
+		}
+	}
+
+	*d = in
+
+	return nil
+}
+
+func (d *PathPatterns) unmarshalEnv(s string) error {
+	byts, _ := json.Marshal(strings.Split(s, ","))
+	return d.UnmarshalJSON(byts)
+}
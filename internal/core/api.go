@@ -3,11 +3,15 @@ package core
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"reflect"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -45,6 +49,7 @@ func loadConfData(ctx *gin.Context) (interface{}, error) {
 	var in struct {
 		// general
 		LogLevel                  *conf.LogLevel        `json:"logLevel"`
+		LogFormat                 *conf.LogFormat       `json:"logFormat"`
 		LogDestinations           *conf.LogDestinations `json:"logDestinations"`
 		LogFile                   *string               `json:"logFile"`
 		ReadTimeout               *conf.StringDuration  `json:"readTimeout"`
@@ -59,6 +64,7 @@ func loadConfData(ctx *gin.Context) (interface{}, error) {
 		PPROFAddress              *string               `json:"pprofAddress"`
 		RunOnConnect              *string               `json:"runOnConnect"`
 		RunOnConnectRestart       *bool                 `json:"runOnConnectRestart"`
+		RunOnDisconnect           *string               `json:"runOnDisconnect"`
 
 		// RTSP
 		RTSPDisable       *bool             `json:"rtspDisable"`
@@ -76,12 +82,47 @@ func loadConfData(ctx *gin.Context) (interface{}, error) {
 		AuthMethods       *conf.AuthMethods `json:"authMethods"`
 
 		// RTMP
-		RTMPDisable    *bool            `json:"rtmpDisable"`
-		RTMPAddress    *string          `json:"rtmpAddress"`
-		RTMPEncryption *conf.Encryption `json:"rtmpEncryption"`
-		RTMPSAddress   *string          `json:"rtmpsAddress"`
-		RTMPServerKey  *string          `json:"rtmpServerKey"`
-		RTMPServerCert *string          `json:"rtmpServerCert"`
+		RTMPDisable              *bool                `json:"rtmpDisable"`
+		RTMPAddress              *string              `json:"rtmpAddress"`
+		RTMPAdditionalAddresses  *conf.Addresses      `json:"rtmpAdditionalAddresses"`
+		RTMPNetwork              *string              `json:"rtmpNetwork"`
+		RTMPReusePort            *bool                `json:"rtmpReusePort"`
+		RTMPListenBacklog        *int                 `json:"rtmpListenBacklog"`
+		RTMPListenRetries        *int                 `json:"rtmpListenRetries"`
+		RTMPListenRetryInterval  *conf.StringDuration `json:"rtmpListenRetryInterval"`
+		RTMPSkipOnListenError    *bool                `json:"rtmpSkipOnListenError"`
+		RTMPTCPReadBufferSize    *int                 `json:"rtmpTCPReadBufferSize"`
+		RTMPTCPWriteBufferSize   *int                 `json:"rtmpTCPWriteBufferSize"`
+		RTMPTCPNoDelayDisable    *bool                `json:"rtmpTCPNoDelayDisable"`
+		RTMPTCPLinger            *conf.StringDuration `json:"rtmpTCPLinger"`
+		RTMPProxyProtocol        *bool                `json:"rtmpProxyProtocol"`
+		RTMPEncryption           *conf.Encryption     `json:"rtmpEncryption"`
+		RTMPSAddress             *string              `json:"rtmpsAddress"`
+		RTMPSAdditionalAddresses *conf.Addresses      `json:"rtmpsAdditionalAddresses"`
+		RTMPServerKey            *string              `json:"rtmpServerKey"`
+		RTMPServerCert           *string              `json:"rtmpServerCert"`
+		RTMPMaxConns             *int                 `json:"rtmpMaxConns"`
+		RTMPConnRateLimit        *int                 `json:"rtmpConnRateLimit"`
+		RTMPConnRateWindow       *conf.StringDuration `json:"rtmpConnRateWindow"`
+		RTMPAllowedNets          *conf.IPsOrCIDRs     `json:"rtmpAllowedNets"`
+		RTMPDeniedNets           *conf.IPsOrCIDRs     `json:"rtmpDeniedNets"`
+		RTMPAllowedPaths         *conf.PathPatterns   `json:"rtmpAllowedPaths"`
+		RTMPConnIDFormat         *conf.ConnIDFormat   `json:"rtmpConnIDFormat"`
+		RTMPConnIDPrefix         *string              `json:"rtmpConnIDPrefix"`
+		RTMPHandshakeTimeout     *conf.StringDuration `json:"rtmpHandshakeTimeout"`
+		RTMPWriteChunkSize       *int                 `json:"rtmpWriteChunkSize"`
+		RTMPConnLogDisable       *bool                `json:"rtmpConnLogDisable"`
+		RTMPReadWaitPublisher    *conf.StringDuration `json:"rtmpReadWaitPublisher"`
+		RTMPReaderKeepalive      *conf.StringDuration `json:"rtmpReaderKeepalive"`
+		RTMPIdleTimeout          *conf.StringDuration `json:"rtmpIdleTimeout"`
+		RTMPSlowWriteThreshold   *conf.StringDuration `json:"rtmpSlowWriteThreshold"`
+		RTMPSlowReaderKickAfter  *conf.StringDuration `json:"rtmpSlowReaderKickAfter"`
+		RTMPShutdownGracePeriod  *conf.StringDuration `json:"rtmpShutdownGracePeriod"`
+		RTMPHandoffURL           *string              `json:"rtmpHandoffURL"`
+		RTMPPublishTokenURL      *string              `json:"rtmpPublishTokenURL"`
+		RTMPRunOnPublish         *string              `json:"rtmpRunOnPublish"`
+		RTMPRunOnUnpublish       *string              `json:"rtmpRunOnUnpublish"`
+		RTMPPublishHookDebounce  *conf.StringDuration `json:"rtmpPublishHookDebounce"`
 
 		// HLS
 		HLSDisable         *bool                `json:"hlsDisable"`
@@ -119,6 +160,9 @@ func loadConfPathData(ctx *gin.Context) (interface{}, error) {
 		SourceRedirect             *string              `json:"sourceRedirect"`
 		DisablePublisherOverride   *bool                `json:"disablePublisherOverride"`
 		Fallback                   *string              `json:"fallback"`
+		RTMPMaxReaders             *int                 `json:"rtmpMaxReaders"`
+		RTMPMaxPublishBitrate      *int                 `json:"rtmpMaxPublishBitrate"`
+		RTMPFallbackFile           *string              `json:"rtmpFallbackFile"`
 		RPICameraCamID             *int                 `json:"rpiCameraCamID"`
 		RPICameraWidth             *int                 `json:"rpiCameraWidth"`
 		RPICameraHeight            *int                 `json:"rpiCameraHeight"`
@@ -143,6 +187,7 @@ func loadConfPathData(ctx *gin.Context) (interface{}, error) {
 		RunOnDemandRestart      *bool                `json:"runOnDemandRestart"`
 		RunOnDemandStartTimeout *conf.StringDuration `json:"runOnDemandStartTimeout"`
 		RunOnDemandCloseAfter   *conf.StringDuration `json:"runOnDemandCloseAfter"`
+		RunOnDemandPolicy       *conf.OnDemandPolicy `json:"runOnDemandPolicy"`
 		RunOnReady              *string              `json:"runOnReady"`
 		RunOnReadyRestart       *bool                `json:"runOnReadyRestart"`
 		RunOnRead               *string              `json:"runOnRead"`
@@ -167,7 +212,14 @@ type apiRTSPServer interface {
 
 type apiRTMPServer interface {
 	apiConnsList(req rtmpServerAPIConnsListReq) rtmpServerAPIConnsListRes
+	apiConnsGet(req rtmpServerAPIConnsGetReq) rtmpServerAPIConnsGetRes
 	apiConnsKick(req rtmpServerAPIConnsKickReq) rtmpServerAPIConnsKickRes
+	apiConnsKickByAddr(req rtmpServerAPIConnsKickByAddrReq) rtmpServerAPIConnsKickByAddrRes
+	apiConnsKickIdle(req rtmpServerAPIConnsKickIdleReq) rtmpServerAPIConnsKickIdleRes
+	apiConnsSubscribe(req rtmpServerAPIConnsSubscribeReq) rtmpServerAPIConnsSubscribeRes
+	apiConnsUnsubscribe(ch chan rtmpServerAPIConnsEvent)
+	apiServerInfo(req rtmpServerAPIServerInfoReq) rtmpServerAPIServerInfoRes
+	apiHealthy() bool
 }
 
 type apiHLSServer interface {
@@ -189,8 +241,10 @@ type api struct {
 	hlsServer   apiHLSServer
 	parent      apiParent
 
-	mutex sync.Mutex
-	s     *http.Server
+	ctx       context.Context
+	ctxCancel func()
+	mutex     sync.Mutex
+	s         *http.Server
 }
 
 func newAPI(
@@ -220,6 +274,8 @@ func newAPI(
 		parent:      parent,
 	}
 
+	a.ctx, a.ctxCancel = context.WithCancel(context.Background())
+
 	router := gin.New()
 	router.SetTrustedProxies(nil)
 	router.NoRoute(a.mwLog)
@@ -245,12 +301,24 @@ func newAPI(
 
 	if !interfaceIsEmpty(a.rtmpServer) {
 		group.GET("/v1/rtmpconns/list", a.onRTMPConnsList)
+		group.GET("/v1/rtmpconns/get/:id", a.onRTMPConnsGet)
 		group.POST("/v1/rtmpconns/kick/:id", a.onRTMPConnsKick)
+		group.POST("/v1/rtmpconns/kickbyaddr/*addr", a.onRTMPConnsKickByAddr)
+		group.POST("/v1/rtmpconns/kickidle", a.onRTMPConnsKickIdle)
+		group.GET("/v1/rtmpconns/events", a.onRTMPConnsEvents)
+		group.GET("/v1/rtmpserver/info", a.onRTMPServerInfo)
+		group.GET("/v1/rtmpserver/health", a.onRTMPServerHealth)
 	}
 
 	if !interfaceIsEmpty(a.rtmpsServer) {
 		group.GET("/v1/rtmpsconns/list", a.onRTMPSConnsList)
+		group.GET("/v1/rtmpsconns/get/:id", a.onRTMPSConnsGet)
 		group.POST("/v1/rtmpsconns/kick/:id", a.onRTMPSConnsKick)
+		group.POST("/v1/rtmpsconns/kickbyaddr/*addr", a.onRTMPSConnsKickByAddr)
+		group.POST("/v1/rtmpsconns/kickidle", a.onRTMPSConnsKickIdle)
+		group.GET("/v1/rtmpsconns/events", a.onRTMPSConnsEvents)
+		group.GET("/v1/rtmpsserver/info", a.onRTMPSServerInfo)
+		group.GET("/v1/rtmpsserver/health", a.onRTMPSServerHealth)
 	}
 
 	if !interfaceIsEmpty(a.hlsServer) {
@@ -268,6 +336,7 @@ func newAPI(
 
 func (a *api) close() {
 	a.log(logger.Info, "listener is closing")
+	a.ctxCancel() // terminate event streams, otherwise Shutdown() would wait for them
 	a.s.Shutdown(context.Background())
 }
 
@@ -506,22 +575,183 @@ func (a *api) onRTSPSSessionsKick(ctx *gin.Context) {
 	ctx.Status(http.StatusOK)
 }
 
+func loadRTMPConnsListReq(ctx *gin.Context) (rtmpServerAPIConnsListReq, bool) {
+	req := rtmpServerAPIConnsListReq{
+		state: ctx.Query("state"),
+	}
+
+	if !rtmpConnStateIsValid(req.state) {
+		return req, false
+	}
+
+	for _, p := range []struct {
+		key string
+		dst *int
+	}{
+		{"page", &req.page},
+		{"itemsPerPage", &req.itemsPerPage},
+	} {
+		if v := ctx.Query(p.key); v != "" {
+			tmp, err := strconv.Atoi(v)
+			if err != nil || tmp < 0 {
+				return req, false
+			}
+			*p.dst = tmp
+		}
+	}
+
+	return req, true
+}
+
+func loadRTMPConnsKickReq(ctx *gin.Context) (rtmpServerAPIConnsKickReq, bool) {
+	req := rtmpServerAPIConnsKickReq{
+		id: ctx.Param("id"),
+	}
+
+	if v := ctx.Query("wait"); v != "" {
+		tmp, err := time.ParseDuration(v)
+		if err != nil || tmp <= 0 || tmp > rtmpServerKickMaxWait {
+			return req, false
+		}
+		req.wait = tmp
+	}
+
+	return req, true
+}
+
+// rtmpConnsErrStatus returns the HTTP status code of an error returned by a RTMP API request.
+func rtmpConnsErrStatus(err error) int {
+	switch {
+	case errors.Is(err, rtmpServerErrConnNotFound):
+		return http.StatusNotFound
+
+	case errors.Is(err, rtmpServerErrInvalidAddr):
+		return http.StatusBadRequest
+
+	case errors.Is(err, rtmpServerErrTerminated):
+		return http.StatusServiceUnavailable
+
+	case errors.Is(err, rtmpServerErrKickTimeout):
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusInternalServerError
+}
+
 func (a *api) onRTMPConnsList(ctx *gin.Context) {
-	res := a.rtmpServer.apiConnsList(rtmpServerAPIConnsListReq{})
+	req, ok := loadRTMPConnsListReq(ctx)
+	if !ok {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	res := a.rtmpServer.apiConnsList(req)
 	if res.err != nil {
-		ctx.AbortWithStatus(http.StatusInternalServerError)
+		ctx.AbortWithStatus(rtmpConnsErrStatus(res.err))
 		return
 	}
 
 	ctx.JSON(http.StatusOK, res.data)
 }
 
-func (a *api) onRTMPConnsKick(ctx *gin.Context) {
+func (a *api) onRTMPConnsGet(ctx *gin.Context) {
 	id := ctx.Param("id")
 
-	res := a.rtmpServer.apiConnsKick(rtmpServerAPIConnsKickReq{id: id})
+	res := a.rtmpServer.apiConnsGet(rtmpServerAPIConnsGetReq{id: id})
 	if res.err != nil {
-		ctx.AbortWithStatus(http.StatusNotFound)
+		ctx.AbortWithStatus(rtmpConnsErrStatus(res.err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res.data)
+}
+
+func (a *api) onRTMPConnsKick(ctx *gin.Context) {
+	req, ok := loadRTMPConnsKickReq(ctx)
+	if !ok {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	res := a.rtmpServer.apiConnsKick(req)
+	if res.err != nil {
+		ctx.AbortWithStatus(rtmpConnsErrStatus(res.err))
+		return
+	}
+
+	ctx.Status(http.StatusOK)
+}
+
+func (a *api) onRTMPConnsKickByAddr(ctx *gin.Context) {
+	addr := ctx.Param("addr")
+	if len(addr) < 2 || addr[0] != '/' {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	addr = addr[1:]
+
+	res := a.rtmpServer.apiConnsKickByAddr(rtmpServerAPIConnsKickByAddrReq{addr: addr})
+	if res.err != nil {
+		ctx.AbortWithStatus(rtmpConnsErrStatus(res.err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res.data)
+}
+
+func (a *api) onRTMPConnsKickIdle(ctx *gin.Context) {
+	res := a.rtmpServer.apiConnsKickIdle(rtmpServerAPIConnsKickIdleReq{})
+	if res.err != nil {
+		ctx.AbortWithStatus(rtmpConnsErrStatus(res.err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res.data)
+}
+
+func (a *api) streamRTMPConnsEvents(ctx *gin.Context, s apiRTMPServer) {
+	res := s.apiConnsSubscribe(rtmpServerAPIConnsSubscribeReq{})
+	if res.err != nil {
+		ctx.AbortWithStatus(rtmpConnsErrStatus(res.err))
+		return
+	}
+	defer s.apiConnsUnsubscribe(res.ch)
+
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case ev, ok := <-res.ch:
+			if !ok {
+				return false
+			}
+			ctx.SSEvent("conn", ev)
+			return true
+
+		case <-ctx.Request.Context().Done():
+			return false
+
+		case <-a.ctx.Done():
+			return false
+		}
+	})
+}
+
+func (a *api) onRTMPConnsEvents(ctx *gin.Context) {
+	a.streamRTMPConnsEvents(ctx, a.rtmpServer)
+}
+
+func (a *api) onRTMPServerInfo(ctx *gin.Context) {
+	res := a.rtmpServer.apiServerInfo(rtmpServerAPIServerInfoReq{})
+	if res.err != nil {
+		ctx.AbortWithStatus(rtmpConnsErrStatus(res.err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res.data)
+}
+
+func (a *api) onRTMPServerHealth(ctx *gin.Context) {
+	if !a.rtmpServer.apiHealthy() {
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
 		return
 	}
 
@@ -529,21 +759,93 @@ func (a *api) onRTMPConnsKick(ctx *gin.Context) {
 }
 
 func (a *api) onRTMPSConnsList(ctx *gin.Context) {
-	res := a.rtmpsServer.apiConnsList(rtmpServerAPIConnsListReq{})
+	req, ok := loadRTMPConnsListReq(ctx)
+	if !ok {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	res := a.rtmpsServer.apiConnsList(req)
 	if res.err != nil {
-		ctx.AbortWithStatus(http.StatusInternalServerError)
+		ctx.AbortWithStatus(rtmpConnsErrStatus(res.err))
 		return
 	}
 
 	ctx.JSON(http.StatusOK, res.data)
 }
 
-func (a *api) onRTMPSConnsKick(ctx *gin.Context) {
+func (a *api) onRTMPSConnsGet(ctx *gin.Context) {
 	id := ctx.Param("id")
 
-	res := a.rtmpsServer.apiConnsKick(rtmpServerAPIConnsKickReq{id: id})
+	res := a.rtmpsServer.apiConnsGet(rtmpServerAPIConnsGetReq{id: id})
 	if res.err != nil {
-		ctx.AbortWithStatus(http.StatusNotFound)
+		ctx.AbortWithStatus(rtmpConnsErrStatus(res.err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res.data)
+}
+
+func (a *api) onRTMPSConnsKick(ctx *gin.Context) {
+	req, ok := loadRTMPConnsKickReq(ctx)
+	if !ok {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	res := a.rtmpsServer.apiConnsKick(req)
+	if res.err != nil {
+		ctx.AbortWithStatus(rtmpConnsErrStatus(res.err))
+		return
+	}
+
+	ctx.Status(http.StatusOK)
+}
+
+func (a *api) onRTMPSConnsKickByAddr(ctx *gin.Context) {
+	addr := ctx.Param("addr")
+	if len(addr) < 2 || addr[0] != '/' {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	addr = addr[1:]
+
+	res := a.rtmpsServer.apiConnsKickByAddr(rtmpServerAPIConnsKickByAddrReq{addr: addr})
+	if res.err != nil {
+		ctx.AbortWithStatus(rtmpConnsErrStatus(res.err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res.data)
+}
+
+func (a *api) onRTMPSConnsKickIdle(ctx *gin.Context) {
+	res := a.rtmpsServer.apiConnsKickIdle(rtmpServerAPIConnsKickIdleReq{})
+	if res.err != nil {
+		ctx.AbortWithStatus(rtmpConnsErrStatus(res.err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res.data)
+}
+
+func (a *api) onRTMPSConnsEvents(ctx *gin.Context) {
+	a.streamRTMPConnsEvents(ctx, a.rtmpsServer)
+}
+
+func (a *api) onRTMPSServerInfo(ctx *gin.Context) {
+	res := a.rtmpsServer.apiServerInfo(rtmpServerAPIServerInfoReq{})
+	if res.err != nil {
+		ctx.AbortWithStatus(rtmpConnsErrStatus(res.err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res.data)
+}
+
+func (a *api) onRTMPSServerHealth(ctx *gin.Context) {
+	if !a.rtmpsServer.apiHealthy() {
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
 		return
 	}
 
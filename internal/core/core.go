@@ -6,6 +6,8 @@ import (
 	"os"
 	"os/signal"
 	"reflect"
+	"sync"
+	"time"
 
 	"github.com/aler9/gortsplib"
 	"github.com/gin-gonic/gin"
@@ -118,6 +120,11 @@ func (p *Core) Log(level logger.Level, format string, args ...interface{}) {
 	p.logger.Log(level, format, args...)
 }
 
+// LogComponent is the logging function of components that report their name separately.
+func (p *Core) LogComponent(level logger.Level, component string, format string, args ...interface{}) {
+	p.logger.LogComponent(level, component, format, args...)
+}
+
 func (p *Core) run() {
 	defer close(p.done)
 
@@ -160,6 +167,7 @@ outer:
 
 		case <-interrupt:
 			p.Log(logger.Info, "shutting down gracefully")
+			p.drainRTMPServers()
 			break outer
 
 		case <-p.ctx.Done():
@@ -172,12 +180,40 @@ outer:
 	p.closeResources(nil, false)
 }
 
+// drainRTMPServers waits for existing RTMP connections to terminate,
+// within the configured grace period, before closing the RTMP servers.
+func (p *Core) drainRTMPServers() {
+	if p.conf.RTMPShutdownGracePeriod == 0 {
+		return
+	}
+
+	var wg sync.WaitGroup
+
+	for _, s := range []*rtmpServer{p.rtmpServer, p.rtmpsServer} {
+		if s == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(s *rtmpServer) {
+			defer wg.Done()
+			s.closeGraceful(time.Duration(p.conf.RTMPShutdownGracePeriod), p.conf.RTMPHandoffURL)
+		}(s)
+	}
+
+	wg.Wait()
+
+	p.rtmpServer = nil
+	p.rtmpsServer = nil
+}
+
 func (p *Core) createResources(initial bool) error {
 	var err error
 
 	if p.logger == nil {
 		p.logger, err = logger.New(
 			logger.Level(p.conf.LogLevel),
+			logger.Format(p.conf.LogFormat),
 			p.conf.LogDestinations,
 			p.conf.LogFile)
 		if err != nil {
@@ -312,22 +348,56 @@ func (p *Core) createResources(initial bool) error {
 			p.rtmpServer, err = newRTMPServer(
 				p.ctx,
 				p.conf.ExternalAuthenticationURL,
-				p.conf.RTMPAddress,
+				newRTMPPublishTokenValidator(p.conf.RTMPPublishTokenURL),
+				append([]string{p.conf.RTMPAddress}, p.conf.RTMPAdditionalAddresses...),
+				p.conf.RTMPNetwork,
+				p.conf.RTMPReusePort,
+				p.conf.RTMPListenBacklog,
+				p.conf.RTMPListenRetries,
+				p.conf.RTMPListenRetryInterval,
+				p.conf.RTMPTCPReadBufferSize,
+				p.conf.RTMPTCPWriteBufferSize,
+				p.conf.RTMPTCPNoDelayDisable,
+				p.conf.RTMPTCPLinger,
+				p.conf.RTMPProxyProtocol,
 				p.conf.ReadTimeout,
 				p.conf.WriteTimeout,
+				p.conf.RTMPHandshakeTimeout,
+				p.conf.RTMPWriteChunkSize,
+				p.conf.RTMPConnLogDisable,
+				p.conf.RTMPReadWaitPublisher,
+				p.conf.RTMPReaderKeepalive,
 				p.conf.ReadBufferCount,
+				p.conf.RTMPMaxConns,
+				p.conf.RTMPConnRateLimit,
+				p.conf.RTMPConnRateWindow,
+				p.conf.RTMPAllowedNets,
+				p.conf.RTMPDeniedNets,
+				p.conf.RTMPAllowedPaths,
+				p.conf.RTMPConnIDFormat,
+				p.conf.RTMPConnIDPrefix,
+				p.conf.RTMPIdleTimeout,
+				p.conf.RTMPSlowWriteThreshold,
+				p.conf.RTMPSlowReaderKickAfter,
 				false,
 				"",
 				"",
 				p.conf.RTSPAddress,
 				p.conf.RunOnConnect,
 				p.conf.RunOnConnectRestart,
+				p.conf.RunOnDisconnect,
+				p.conf.RTMPRunOnPublish,
+				p.conf.RTMPRunOnUnpublish,
+				p.conf.RTMPPublishHookDebounce,
 				p.externalCmdPool,
 				p.metrics,
 				p.pathManager,
 				p)
 			if err != nil {
-				return err
+				if _, ok := err.(rtmpServerErrListen); !ok || !p.conf.RTMPSkipOnListenError {
+					return err
+				}
+				p.LogComponent(logger.Warn, "RTMP", "server is disabled, unable to open listener: %s", err)
 			}
 		}
 	}
@@ -339,22 +409,56 @@ func (p *Core) createResources(initial bool) error {
 			p.rtmpsServer, err = newRTMPServer(
 				p.ctx,
 				p.conf.ExternalAuthenticationURL,
-				p.conf.RTMPSAddress,
+				newRTMPPublishTokenValidator(p.conf.RTMPPublishTokenURL),
+				append([]string{p.conf.RTMPSAddress}, p.conf.RTMPSAdditionalAddresses...),
+				p.conf.RTMPNetwork,
+				p.conf.RTMPReusePort,
+				p.conf.RTMPListenBacklog,
+				p.conf.RTMPListenRetries,
+				p.conf.RTMPListenRetryInterval,
+				p.conf.RTMPTCPReadBufferSize,
+				p.conf.RTMPTCPWriteBufferSize,
+				p.conf.RTMPTCPNoDelayDisable,
+				p.conf.RTMPTCPLinger,
+				p.conf.RTMPProxyProtocol,
 				p.conf.ReadTimeout,
 				p.conf.WriteTimeout,
+				p.conf.RTMPHandshakeTimeout,
+				p.conf.RTMPWriteChunkSize,
+				p.conf.RTMPConnLogDisable,
+				p.conf.RTMPReadWaitPublisher,
+				p.conf.RTMPReaderKeepalive,
 				p.conf.ReadBufferCount,
+				p.conf.RTMPMaxConns,
+				p.conf.RTMPConnRateLimit,
+				p.conf.RTMPConnRateWindow,
+				p.conf.RTMPAllowedNets,
+				p.conf.RTMPDeniedNets,
+				p.conf.RTMPAllowedPaths,
+				p.conf.RTMPConnIDFormat,
+				p.conf.RTMPConnIDPrefix,
+				p.conf.RTMPIdleTimeout,
+				p.conf.RTMPSlowWriteThreshold,
+				p.conf.RTMPSlowReaderKickAfter,
 				true,
 				p.conf.RTMPServerCert,
 				p.conf.RTMPServerKey,
 				p.conf.RTSPAddress,
 				p.conf.RunOnConnect,
 				p.conf.RunOnConnectRestart,
+				p.conf.RunOnDisconnect,
+				p.conf.RTMPRunOnPublish,
+				p.conf.RTMPRunOnUnpublish,
+				p.conf.RTMPPublishHookDebounce,
 				p.externalCmdPool,
 				p.metrics,
 				p.pathManager,
 				p)
 			if err != nil {
-				return err
+				if _, ok := err.(rtmpServerErrListen); !ok || !p.conf.RTMPSkipOnListenError {
+					return err
+				}
+				p.LogComponent(logger.Warn, "RTMPS", "server is disabled, unable to open listener: %s", err)
 			}
 		}
 	}
@@ -417,6 +521,7 @@ func (p *Core) createResources(initial bool) error {
 func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 	closeLogger := false
 	if newConf == nil ||
+		newConf.LogFormat != p.conf.LogFormat ||
 		!reflect.DeepEqual(newConf.LogDestinations, p.conf.LogDestinations) ||
 		newConf.LogFile != p.conf.LogFile {
 		closeLogger = true
@@ -439,13 +544,20 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 	closePathManager := false
 	if newConf == nil ||
 		newConf.RTSPAddress != p.conf.RTSPAddress ||
-		newConf.ReadTimeout != p.conf.ReadTimeout ||
-		newConf.WriteTimeout != p.conf.WriteTimeout ||
 		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
 		closeMetrics {
 		closePathManager = true
-	} else if !reflect.DeepEqual(newConf.Paths, p.conf.Paths) {
-		p.pathManager.confReload(newConf.Paths)
+	} else {
+		// apply timeouts without closing the path manager, in order not to
+		// close the RTMP servers, which depend on it.
+		if newConf.ReadTimeout != p.conf.ReadTimeout ||
+			newConf.WriteTimeout != p.conf.WriteTimeout {
+			p.pathManager.timeoutsReload(newConf.ReadTimeout, newConf.WriteTimeout)
+		}
+
+		if !reflect.DeepEqual(newConf.Paths, p.conf.Paths) {
+			p.pathManager.confReload(newConf.Paths)
+		}
 	}
 
 	closeRTSPServer := false
@@ -499,13 +611,36 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		newConf.RTMPDisable != p.conf.RTMPDisable ||
 		newConf.RTMPEncryption != p.conf.RTMPEncryption ||
 		newConf.RTMPAddress != p.conf.RTMPAddress ||
+		!reflect.DeepEqual(newConf.RTMPAdditionalAddresses, p.conf.RTMPAdditionalAddresses) ||
+		newConf.RTMPNetwork != p.conf.RTMPNetwork ||
+		newConf.RTMPReusePort != p.conf.RTMPReusePort ||
+		newConf.RTMPListenBacklog != p.conf.RTMPListenBacklog ||
+		newConf.RTMPListenRetries != p.conf.RTMPListenRetries ||
+		newConf.RTMPListenRetryInterval != p.conf.RTMPListenRetryInterval ||
+		newConf.RTMPSkipOnListenError != p.conf.RTMPSkipOnListenError ||
+		newConf.RTMPTCPReadBufferSize != p.conf.RTMPTCPReadBufferSize ||
+		newConf.RTMPTCPWriteBufferSize != p.conf.RTMPTCPWriteBufferSize ||
+		newConf.RTMPTCPNoDelayDisable != p.conf.RTMPTCPNoDelayDisable ||
+		newConf.RTMPTCPLinger != p.conf.RTMPTCPLinger ||
+		newConf.RTMPProxyProtocol != p.conf.RTMPProxyProtocol ||
+		newConf.RTMPMaxConns != p.conf.RTMPMaxConns ||
+		newConf.RTMPConnRateLimit != p.conf.RTMPConnRateLimit ||
+		newConf.RTMPConnRateWindow != p.conf.RTMPConnRateWindow ||
+		!reflect.DeepEqual(newConf.RTMPAllowedNets, p.conf.RTMPAllowedNets) ||
+		!reflect.DeepEqual(newConf.RTMPDeniedNets, p.conf.RTMPDeniedNets) ||
+		!reflect.DeepEqual(newConf.RTMPAllowedPaths, p.conf.RTMPAllowedPaths) ||
+		newConf.RTMPConnIDFormat != p.conf.RTMPConnIDFormat ||
+		newConf.RTMPConnIDPrefix != p.conf.RTMPConnIDPrefix ||
+		newConf.RTMPIdleTimeout != p.conf.RTMPIdleTimeout ||
+		newConf.RTMPSlowWriteThreshold != p.conf.RTMPSlowWriteThreshold ||
+		newConf.RTMPSlowReaderKickAfter != p.conf.RTMPSlowReaderKickAfter ||
+		newConf.RTMPPublishTokenURL != p.conf.RTMPPublishTokenURL ||
+		newConf.RTMPRunOnPublish != p.conf.RTMPRunOnPublish ||
+		newConf.RTMPRunOnUnpublish != p.conf.RTMPRunOnUnpublish ||
+		newConf.RTMPPublishHookDebounce != p.conf.RTMPPublishHookDebounce ||
 		newConf.ExternalAuthenticationURL != p.conf.ExternalAuthenticationURL ||
-		newConf.ReadTimeout != p.conf.ReadTimeout ||
-		newConf.WriteTimeout != p.conf.WriteTimeout ||
 		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
 		newConf.RTSPAddress != p.conf.RTSPAddress ||
-		newConf.RunOnConnect != p.conf.RunOnConnect ||
-		newConf.RunOnConnectRestart != p.conf.RunOnConnectRestart ||
 		closeMetrics ||
 		closePathManager {
 		closeRTMPServer = true
@@ -516,15 +651,38 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		newConf.RTMPDisable != p.conf.RTMPDisable ||
 		newConf.RTMPEncryption != p.conf.RTMPEncryption ||
 		newConf.RTMPSAddress != p.conf.RTMPSAddress ||
+		!reflect.DeepEqual(newConf.RTMPSAdditionalAddresses, p.conf.RTMPSAdditionalAddresses) ||
+		newConf.RTMPNetwork != p.conf.RTMPNetwork ||
+		newConf.RTMPReusePort != p.conf.RTMPReusePort ||
+		newConf.RTMPListenBacklog != p.conf.RTMPListenBacklog ||
+		newConf.RTMPListenRetries != p.conf.RTMPListenRetries ||
+		newConf.RTMPListenRetryInterval != p.conf.RTMPListenRetryInterval ||
+		newConf.RTMPSkipOnListenError != p.conf.RTMPSkipOnListenError ||
+		newConf.RTMPTCPReadBufferSize != p.conf.RTMPTCPReadBufferSize ||
+		newConf.RTMPTCPWriteBufferSize != p.conf.RTMPTCPWriteBufferSize ||
+		newConf.RTMPTCPNoDelayDisable != p.conf.RTMPTCPNoDelayDisable ||
+		newConf.RTMPTCPLinger != p.conf.RTMPTCPLinger ||
+		newConf.RTMPProxyProtocol != p.conf.RTMPProxyProtocol ||
+		newConf.RTMPMaxConns != p.conf.RTMPMaxConns ||
+		newConf.RTMPConnRateLimit != p.conf.RTMPConnRateLimit ||
+		newConf.RTMPConnRateWindow != p.conf.RTMPConnRateWindow ||
+		!reflect.DeepEqual(newConf.RTMPAllowedNets, p.conf.RTMPAllowedNets) ||
+		!reflect.DeepEqual(newConf.RTMPDeniedNets, p.conf.RTMPDeniedNets) ||
+		!reflect.DeepEqual(newConf.RTMPAllowedPaths, p.conf.RTMPAllowedPaths) ||
+		newConf.RTMPConnIDFormat != p.conf.RTMPConnIDFormat ||
+		newConf.RTMPConnIDPrefix != p.conf.RTMPConnIDPrefix ||
+		newConf.RTMPIdleTimeout != p.conf.RTMPIdleTimeout ||
+		newConf.RTMPSlowWriteThreshold != p.conf.RTMPSlowWriteThreshold ||
+		newConf.RTMPSlowReaderKickAfter != p.conf.RTMPSlowReaderKickAfter ||
+		newConf.RTMPPublishTokenURL != p.conf.RTMPPublishTokenURL ||
+		newConf.RTMPRunOnPublish != p.conf.RTMPRunOnPublish ||
+		newConf.RTMPRunOnUnpublish != p.conf.RTMPRunOnUnpublish ||
+		newConf.RTMPPublishHookDebounce != p.conf.RTMPPublishHookDebounce ||
 		newConf.ExternalAuthenticationURL != p.conf.ExternalAuthenticationURL ||
-		newConf.ReadTimeout != p.conf.ReadTimeout ||
-		newConf.WriteTimeout != p.conf.WriteTimeout ||
 		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
 		newConf.RTMPServerCert != p.conf.RTMPServerCert ||
 		newConf.RTMPServerKey != p.conf.RTMPServerKey ||
 		newConf.RTSPAddress != p.conf.RTSPAddress ||
-		newConf.RunOnConnect != p.conf.RunOnConnect ||
-		newConf.RunOnConnectRestart != p.conf.RunOnConnectRestart ||
 		closeMetrics ||
 		closePathManager {
 		closeRTMPSServer = true
@@ -598,14 +756,34 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		p.hlsServer = nil
 	}
 
-	if closeRTMPSServer && p.rtmpsServer != nil {
-		p.rtmpsServer.close()
-		p.rtmpsServer = nil
+	reloadRTMPServer := newConf != nil &&
+		(newConf.ReadTimeout != p.conf.ReadTimeout ||
+			newConf.WriteTimeout != p.conf.WriteTimeout ||
+			newConf.RTMPHandshakeTimeout != p.conf.RTMPHandshakeTimeout ||
+			newConf.RTMPWriteChunkSize != p.conf.RTMPWriteChunkSize ||
+			newConf.RTMPConnLogDisable != p.conf.RTMPConnLogDisable ||
+			newConf.RTMPReadWaitPublisher != p.conf.RTMPReadWaitPublisher ||
+			newConf.RTMPReaderKeepalive != p.conf.RTMPReaderKeepalive ||
+			newConf.RunOnConnect != p.conf.RunOnConnect ||
+			newConf.RunOnConnectRestart != p.conf.RunOnConnectRestart ||
+			newConf.RunOnDisconnect != p.conf.RunOnDisconnect)
+
+	if p.rtmpsServer != nil {
+		if closeRTMPSServer {
+			p.rtmpsServer.close()
+			p.rtmpsServer = nil
+		} else if reloadRTMPServer {
+			p.rtmpsServer.confReload(newRTMPServerConfReloadReq(newConf))
+		}
 	}
 
-	if closeRTMPServer && p.rtmpServer != nil {
-		p.rtmpServer.close()
-		p.rtmpServer = nil
+	if p.rtmpServer != nil {
+		if closeRTMPServer {
+			p.rtmpServer.close()
+			p.rtmpServer = nil
+		} else if reloadRTMPServer {
+			p.rtmpServer.confReload(newRTMPServerConfReloadReq(newConf))
+		}
 	}
 
 	if closePPROF && p.pprof != nil {
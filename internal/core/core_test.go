@@ -2,6 +2,7 @@ package core
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -17,6 +18,10 @@ import (
 	"github.com/aler9/gortsplib/pkg/headers"
 	"github.com/aler9/gortsplib/pkg/url"
 	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+	"github.com/aler9/rtsp-simple-server/internal/externalcmd"
+	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
 var serverCert = []byte(`-----BEGIN CERTIFICATE-----
@@ -358,6 +363,131 @@ func main() {
 	}
 }
 
+type testPathParent struct{}
+
+func (testPathParent) Log(logger.Level, string, ...interface{}) {}
+
+func (testPathParent) log(logger.Level, string, ...interface{}) {}
+
+func (testPathParent) pathSourceReady(*path) {}
+
+func (testPathParent) pathSourceNotReady(*path) {}
+
+func (testPathParent) onPathClose(*path) {}
+
+type testPublisher struct {
+	closed bool
+}
+
+func (p *testPublisher) close() {
+	p.closed = true
+}
+
+func (p *testPublisher) apiSourceDescribe() interface{} {
+	return nil
+}
+
+func TestCorePathRunOnDemandPolicy(t *testing.T) {
+	track := &gortsplib.TrackH264{
+		PayloadType: 96,
+		SPS:         []byte{0x01, 0x02, 0x03, 0x04},
+		PPS:         []byte{0x01, 0x02, 0x03, 0x04},
+	}
+
+	newTestPath := func(policy conf.OnDemandPolicy, pool *externalcmd.Pool) *path {
+		return &path{
+			name: "mypath",
+			conf: &conf.PathConf{
+				Source:            "publisher",
+				RunOnDemand:       "sleep 10",
+				RunOnDemandPolicy: policy,
+			},
+			externalCmdPool:             pool,
+			parent:                      testPathParent{},
+			readers:                     make(map[reader]pathReaderState),
+			monitors:                    make(map[reader]struct{}),
+			onDemandPublisherReadyTimer: newEmptyTimer(),
+			onDemandPublisherCloseTimer: newEmptyTimer(),
+		}
+	}
+
+	announce := func(pa *path, p publisher) error {
+		req := pathPublisherAddReq{author: p, res: make(chan pathPublisherAnnounceRes, 1)}
+		pa.handlePublisherAnnounce(req)
+		return (<-req.res).err
+	}
+
+	record := func(pa *path, p publisher) {
+		req := pathPublisherStartReq{author: p, tracks: gortsplib.Tracks{track}, res: make(chan pathPublisherRecordRes, 1)}
+		pa.handlePublisherRecord(req)
+		require.NoError(t, (<-req.res).err)
+	}
+
+	for _, ca := range []struct {
+		name   string
+		policy conf.OnDemandPolicy
+	}{
+		{"publisher", conf.OnDemandPolicyPublisher},
+		{"ondemand", conf.OnDemandPolicyOnDemand},
+	} {
+		t.Run(ca.name+" command first", func(t *testing.T) {
+			pool := externalcmd.NewPool()
+			defer pool.Close()
+
+			pa := newTestPath(ca.policy, pool)
+			pa.onDemandPublisherStart()
+
+			cmdPub := &testPublisher{}
+			require.NoError(t, announce(pa, cmdPub))
+			record(pa, cmdPub)
+
+			extPub := &testPublisher{}
+			err := announce(pa, extPub)
+
+			if ca.policy == conf.OnDemandPolicyPublisher {
+				require.NoError(t, err)
+				require.Equal(t, true, cmdPub.closed)
+				require.Equal(t, publisher(extPub), pa.source)
+				require.Nil(t, pa.onDemandCmd)
+			} else {
+				require.EqualError(t, err, "path 'mypath' is being published by its runOnDemand command")
+				require.Equal(t, false, cmdPub.closed)
+				require.Equal(t, publisher(cmdPub), pa.source)
+				require.NotNil(t, pa.onDemandCmd)
+				pa.onDemandPublisherStop()
+			}
+		})
+
+		t.Run(ca.name+" publisher first", func(t *testing.T) {
+			pool := externalcmd.NewPool()
+			defer pool.Close()
+
+			pa := newTestPath(ca.policy, pool)
+
+			// the publisher announces before the command is started,
+			// and doesn't start publishing.
+			extPub := &testPublisher{}
+			require.NoError(t, announce(pa, extPub))
+
+			pa.onDemandPublisherStart()
+
+			// the publisher of the command is not subject to the policy.
+			cmdPub := &testPublisher{}
+			require.NoError(t, announce(pa, cmdPub))
+			require.Equal(t, true, extPub.closed)
+			require.Equal(t, publisher(cmdPub), pa.source)
+			require.NotNil(t, pa.onDemandCmd)
+
+			record(pa, cmdPub)
+			require.Equal(t, pathOnDemandStateClosing, pa.onDemandPublisherState)
+
+			pa.onDemandPublisherStop()
+			require.Equal(t, true, cmdPub.closed)
+			require.Nil(t, pa.onDemandPublisher)
+		})
+	}
+}
+
 func TestCorePathRunOnReady(t *testing.T) {
 	doneFile := filepath.Join(os.TempDir(), "onready_done")
 	defer os.Remove(doneFile)
@@ -444,3 +574,44 @@ func TestCoreHotReloading(t *testing.T) {
 		defer conn.Close()
 	}()
 }
+
+func TestCorePathManagerTimeoutsReload(t *testing.T) {
+	pool := externalcmd.NewPool()
+	defer pool.Close()
+
+	pm := newPathManager(
+		context.Background(),
+		":8554",
+		conf.StringDuration(10*time.Second),
+		conf.StringDuration(10*time.Second),
+		512,
+		map[string]*conf.PathConf{
+			"static": {
+				Source:         "rtsp://127.0.0.1:8555/mypath",
+				SourceOnDemand: true,
+			},
+			"publisher": {
+				Source: "publisher",
+			},
+		},
+		pool,
+		nil,
+		testPathParent{})
+	defer pm.close()
+
+	before := pm.apiPathsList(pathAPIPathsListReq{})
+	require.NoError(t, before.err)
+
+	pm.timeoutsReload(conf.StringDuration(7*time.Second), conf.StringDuration(8*time.Second))
+
+	after := pm.apiPathsList(pathAPIPathsListReq{})
+	require.NoError(t, after.err)
+
+	// paths with a static source are recreated with the new timeouts.
+	require.NotEqual(t, before.paths["static"], after.paths["static"])
+	require.Equal(t, conf.StringDuration(7*time.Second), after.paths["static"].readTimeout)
+	require.Equal(t, conf.StringDuration(8*time.Second), after.paths["static"].writeTimeout)
+
+	// other paths are left untouched.
+	require.Equal(t, before.paths["publisher"], after.paths["publisher"])
+}
@@ -10,16 +10,16 @@ import (
 
 type httpLogWriter struct {
 	gin.ResponseWriter
-	buf bytes.Buffer
+	bodyLen int // body is not stored, since responses can be streamed
 }
 
 func (w *httpLogWriter) Write(b []byte) (int, error) {
-	w.buf.Write(b)
+	w.bodyLen += len(b)
 	return w.ResponseWriter.Write(b)
 }
 
 func (w *httpLogWriter) WriteString(s string) (int, error) {
-	w.buf.WriteString(s)
+	w.bodyLen += len(s)
 	return w.ResponseWriter.WriteString(s)
 }
 
@@ -28,8 +28,8 @@ func (w *httpLogWriter) dump() string {
 	fmt.Fprintf(&buf, "%s %d %s\n", "HTTP/1.1", w.ResponseWriter.Status(), http.StatusText(w.ResponseWriter.Status()))
 	w.ResponseWriter.Header().Write(&buf)
 	buf.Write([]byte("\n"))
-	if w.buf.Len() > 0 {
-		fmt.Fprintf(&buf, "(body of %d bytes)", w.buf.Len())
+	if w.bodyLen > 0 {
+		fmt.Fprintf(&buf, "(body of %d bytes)", w.bodyLen)
 	}
 	return buf.String()
 }
@@ -7,6 +7,8 @@ import (
 	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -17,6 +19,50 @@ func metric(key string, value int64) string {
 	return key + " " + strconv.FormatInt(value, 10) + "\n"
 }
 
+// metricsHistogram is a histogram of durations that can be filled concurrently.
+type metricsHistogram struct {
+	sum     int64 // first for 64-bit alignment, in nanoseconds
+	count   uint64
+	buckets []float64 // upper bounds, in seconds
+	counts  []uint64
+}
+
+func newMetricsHistogram(buckets []float64) *metricsHistogram {
+	return &metricsHistogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *metricsHistogram) observe(d time.Duration) {
+	for i, b := range h.buckets {
+		if d.Seconds() <= b {
+			atomic.AddUint64(&h.counts[i], 1)
+			break
+		}
+	}
+	atomic.AddInt64(&h.sum, int64(d))
+	atomic.AddUint64(&h.count, 1)
+}
+
+// format returns the histogram in the Prometheus text format, with cumulative buckets.
+func (h *metricsHistogram) format(name string) string {
+	out := ""
+	cumulative := uint64(0)
+
+	for i, b := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		out += metric(name+"_bucket{le=\""+strconv.FormatFloat(b, 'f', -1, 64)+"\"}", int64(cumulative))
+	}
+
+	count := atomic.LoadUint64(&h.count)
+	out += metric(name+"_bucket{le=\"+Inf\"}", int64(count))
+	out += name + "_sum " + strconv.FormatFloat(time.Duration(atomic.LoadInt64(&h.sum)).Seconds(), 'f', -1, 64) + "\n"
+	out += metric(name+"_count", int64(count))
+
+	return out
+}
+
 type metricsPathManager interface {
 	apiPathsList(req pathAPIPathsListReq) pathAPIPathsListRes
 }
@@ -27,6 +73,10 @@ type metricsRTSPServer interface {
 
 type metricsRTMPServer interface {
 	apiConnsList(req rtmpServerAPIConnsListReq) rtmpServerAPIConnsListRes
+	connsLimit() int
+	connsStats() rtmpServerConnsStats
+	handshakeDurations() *metricsHistogram
+	pathsStats() map[string]rtmpServerPathStats
 }
 
 type metricsHLSServer interface {
@@ -40,6 +90,8 @@ type metricsParent interface {
 type metrics struct {
 	parent metricsParent
 
+	ctx         context.Context
+	ctxCancel   func()
 	ln          net.Listener
 	server      *http.Server
 	mutex       sync.Mutex
@@ -47,7 +99,12 @@ type metrics struct {
 	rtspServer  metricsRTSPServer
 	rtspsServer metricsRTSPServer
 	rtmpServer  metricsRTMPServer
+	rtmpsServer metricsRTMPServer
 	hlsServer   metricsHLSServer
+
+	// in
+	chRTMPServerSet  chan metricsRTMPServer
+	chRTMPSServerSet chan metricsRTMPServer
 }
 
 func newMetrics(
@@ -59,9 +116,15 @@ func newMetrics(
 		return nil, err
 	}
 
+	ctx, ctxCancel := context.WithCancel(context.Background())
+
 	m := &metrics{
-		parent: parent,
-		ln:     ln,
+		parent:           parent,
+		ctx:              ctx,
+		ctxCancel:        ctxCancel,
+		ln:               ln,
+		chRTMPServerSet:  make(chan metricsRTMPServer, 1),
+		chRTMPSServerSet: make(chan metricsRTMPServer, 1),
 	}
 
 	router := gin.New()
@@ -73,12 +136,14 @@ func newMetrics(
 	m.log(logger.Info, "listener opened on "+address)
 
 	go m.run()
+	go m.runSet()
 
 	return m, nil
 }
 
 func (m *metrics) close() {
 	m.log(logger.Info, "listener is closing")
+	m.ctxCancel()
 	m.server.Shutdown(context.Background())
 }
 
@@ -93,6 +158,26 @@ func (m *metrics) run() {
 	}
 }
 
+// runSet applies the updates that are queued by non-blocking setters.
+func (m *metrics) runSet() {
+	for {
+		select {
+		case s := <-m.chRTMPServerSet:
+			m.mutex.Lock()
+			m.rtmpServer = s
+			m.mutex.Unlock()
+
+		case s := <-m.chRTMPSServerSet:
+			m.mutex.Lock()
+			m.rtmpsServer = s
+			m.mutex.Unlock()
+
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
 func (m *metrics) onMetrics(ctx *gin.Context) {
 	out := ""
 
@@ -161,32 +246,13 @@ func (m *metrics) onMetrics(ctx *gin.Context) {
 		}
 	}
 
-	if !interfaceIsEmpty(m.rtmpServer) {
-		res := m.rtmpServer.apiConnsList(rtmpServerAPIConnsListReq{})
-		if res.err == nil {
-			idleCount := int64(0)
-			readCount := int64(0)
-			publishCount := int64(0)
-
-			for _, i := range res.data.Items {
-				switch i.State {
-				case "idle":
-					idleCount++
-				case "read":
-					readCount++
-				case "publish":
-					publishCount++
-				}
-			}
+	m.mutex.Lock()
+	rtmpServer := m.rtmpServer
+	rtmpsServer := m.rtmpsServer
+	m.mutex.Unlock()
 
-			out += metric("rtmp_conns{state=\"idle\"}",
-				idleCount)
-			out += metric("rtmp_conns{state=\"read\"}",
-				readCount)
-			out += metric("rtmp_conns{state=\"publish\"}",
-				publishCount)
-		}
-	}
+	out += metricsRTMPServerFormat("rtmp", rtmpServer)
+	out += metricsRTMPServerFormat("rtmps", rtmpsServer)
 
 	if !interfaceIsEmpty(m.hlsServer) {
 		res := m.hlsServer.apiHLSMuxersList(hlsServerAPIMuxersListReq{})
@@ -201,6 +267,72 @@ func (m *metrics) onMetrics(ctx *gin.Context) {
 	io.WriteString(ctx.Writer, out)
 }
 
+// metricsRTMPServerFormat returns the metrics of a RTMP server, with the given prefix.
+func metricsRTMPServerFormat(prefix string, s metricsRTMPServer) string {
+	if interfaceIsEmpty(s) {
+		return ""
+	}
+
+	res := s.apiConnsList(rtmpServerAPIConnsListReq{})
+	if res.err != nil {
+		return ""
+	}
+
+	out := ""
+
+	idleCount := int64(0)
+	authCount := int64(0)
+	readCount := int64(0)
+	publishCount := int64(0)
+	monitorCount := int64(0)
+
+	for _, i := range res.data.Items {
+		switch i.State {
+		case "idle":
+			idleCount++
+		case "auth":
+			authCount++
+		case "read":
+			readCount++
+		case "publish":
+			publishCount++
+		case "monitor":
+			monitorCount++
+		}
+	}
+
+	out += metric(prefix+"_conns{state=\"idle\"}",
+		idleCount)
+	out += metric(prefix+"_conns{state=\"auth\"}",
+		authCount)
+	out += metric(prefix+"_conns{state=\"read\"}",
+		readCount)
+	out += metric(prefix+"_conns{state=\"publish\"}",
+		publishCount)
+	out += metric(prefix+"_conns{state=\"monitor\"}",
+		monitorCount)
+
+	stats := s.connsStats()
+	out += metric(prefix+"_conns_accepted_total", int64(stats.accepted))
+	out += metric(prefix+"_conns_kicked_total", int64(stats.kicked))
+	out += metric(prefix+"_conns_refused_total{reason=\"limit\"}", int64(stats.refusedLimit))
+	out += metric(prefix+"_conns_refused_total{reason=\"denied\"}", int64(stats.refusedDenied))
+	out += metric(prefix+"_conns_refused_total{reason=\"rate\"}", int64(stats.refusedRate))
+
+	out += s.handshakeDurations().format(prefix + "_handshake_duration_seconds")
+
+	for name, st := range s.pathsStats() {
+		out += metric(prefix+"_path_bytes_received_total{name=\""+name+"\"}", int64(st.bytesReceived))
+		out += metric(prefix+"_path_bytes_sent_total{name=\""+name+"\"}", int64(st.bytesSent))
+	}
+
+	if limit := s.connsLimit(); limit != 0 {
+		out += metric(prefix+"_conns_limit", int64(limit))
+	}
+
+	return out
+}
+
 // pathManagerSet is called by pathManager.
 func (m *metrics) pathManagerSet(s metricsPathManager) {
 	m.mutex.Lock()
@@ -222,11 +354,34 @@ func (m *metrics) rtspsServerSet(s metricsRTSPServer) {
 	m.rtspsServer = s
 }
 
-// rtmpServerSet is called by rtmpServer.
+// rtmpServerSet is called by rtmpServer (plain).
+// It never blocks, in order not to stall the server when metrics are slow;
+// if the previous update has not been applied yet, it is replaced.
 func (m *metrics) rtmpServerSet(s metricsRTMPServer) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	m.rtmpServer = s
+	metricsSetLatest(m.chRTMPServerSet, s)
+}
+
+// rtmpsServerSet is called by rtmpServer (tls).
+// It never blocks, like rtmpServerSet.
+func (m *metrics) rtmpsServerSet(s metricsRTMPServer) {
+	metricsSetLatest(m.chRTMPSServerSet, s)
+}
+
+// metricsSetLatest queues an update into a slot of size 1,
+// replacing the previous update if it has not been applied yet.
+func metricsSetLatest(ch chan metricsRTMPServer, s metricsRTMPServer) {
+	for {
+		select {
+		case ch <- s:
+			return
+		default:
+		}
+
+		select {
+		case <-ch:
+		default:
+		}
+	}
 }
 
 // hlsServerSet is called by hlsServer.
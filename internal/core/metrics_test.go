@@ -1,11 +1,13 @@
 package core
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aler9/gortsplib"
 	"github.com/stretchr/testify/require"
@@ -78,18 +80,124 @@ func TestMetrics(t *testing.T) {
 		vals[fields[0]] = fields[1]
 	}
 
+	// the handshake duration depends on timing, check only the count.
+	require.Equal(t, "1", vals["rtmp_handshake_duration_seconds_count"])
+	require.Equal(t, "1", vals["rtmp_handshake_duration_seconds_bucket{le=\"+Inf\"}"])
+	for k := range vals {
+		if strings.HasPrefix(k, "rtmp_handshake_duration_seconds") {
+			delete(vals, k)
+		}
+	}
+
+	// bytes depend on timing, check only that they are present.
+	require.Contains(t, vals, "rtmp_path_bytes_received_total{name=\"rtmp_path\"}")
+	require.Contains(t, vals, "rtmp_path_bytes_sent_total{name=\"rtmp_path\"}")
+	delete(vals, "rtmp_path_bytes_received_total{name=\"rtmp_path\"}")
+	delete(vals, "rtmp_path_bytes_sent_total{name=\"rtmp_path\"}")
+
 	require.Equal(t, map[string]string{
-		"hls_muxers{name=\"rtsp_path\"}":            "1",
-		"paths{name=\"rtsp_path\",state=\"ready\"}": "1",
-		"paths{name=\"rtmp_path\",state=\"ready\"}": "1",
-		"rtmp_conns{state=\"idle\"}":                "0",
-		"rtmp_conns{state=\"publish\"}":             "1",
-		"rtmp_conns{state=\"read\"}":                "0",
-		"rtsp_sessions{state=\"idle\"}":             "0",
-		"rtsp_sessions{state=\"publish\"}":          "1",
-		"rtsp_sessions{state=\"read\"}":             "0",
-		"rtsps_sessions{state=\"idle\"}":            "0",
-		"rtsps_sessions{state=\"publish\"}":         "0",
-		"rtsps_sessions{state=\"read\"}":            "0",
+		"hls_muxers{name=\"rtsp_path\"}":              "1",
+		"paths{name=\"rtsp_path\",state=\"ready\"}":   "1",
+		"paths{name=\"rtmp_path\",state=\"ready\"}":   "1",
+		"rtmp_conns{state=\"idle\"}":                  "0",
+		"rtmp_conns{state=\"auth\"}":                  "0",
+		"rtmp_conns{state=\"publish\"}":               "1",
+		"rtmp_conns{state=\"read\"}":                  "0",
+		"rtmp_conns{state=\"monitor\"}":               "0",
+		"rtmp_conns_accepted_total":                   "1",
+		"rtmp_conns_kicked_total":                     "0",
+		"rtmp_conns_refused_total{reason=\"limit\"}":  "0",
+		"rtmp_conns_refused_total{reason=\"denied\"}": "0",
+		"rtmp_conns_refused_total{reason=\"rate\"}":   "0",
+		"rtsp_sessions{state=\"idle\"}":               "0",
+		"rtsp_sessions{state=\"publish\"}":            "1",
+		"rtsp_sessions{state=\"read\"}":               "0",
+		"rtsps_sessions{state=\"idle\"}":              "0",
+		"rtsps_sessions{state=\"publish\"}":           "0",
+		"rtsps_sessions{state=\"read\"}":              "0",
 	}, vals)
 }
+
+func TestMetricsHistogram(t *testing.T) {
+	h := newMetricsHistogram([]float64{0.001, 0.1, 1})
+	h.observe(500 * time.Microsecond)
+	h.observe(50 * time.Millisecond)
+	h.observe(2 * time.Second)
+
+	require.Equal(t, "test_bucket{le=\"0.001\"} 1\n"+
+		"test_bucket{le=\"0.1\"} 2\n"+
+		"test_bucket{le=\"1\"} 2\n"+
+		"test_bucket{le=\"+Inf\"} 3\n"+
+		"test_sum 2.0505\n"+
+		"test_count 3\n", h.format("test"))
+}
+
+func TestMetricsRTMPServerSetNonBlocking(t *testing.T) {
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+
+	m := &metrics{
+		ctx:              ctx,
+		ctxCancel:        ctxCancel,
+		chRTMPServerSet:  make(chan metricsRTMPServer, 1),
+		chRTMPSServerSet: make(chan metricsRTMPServer, 1),
+	}
+	go m.runSet()
+
+	// simulate a metrics consumer that is stuck.
+	m.mutex.Lock()
+
+	s1 := &rtmpServer{}
+	s2 := &rtmpServer{}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.rtmpServerSet(s1)
+		m.rtmpServerSet(s2)
+		m.rtmpServerSet(nil)
+		m.rtmpServerSet(s2)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("rtmpServerSet is blocked")
+	}
+
+	m.mutex.Unlock()
+	time.Sleep(100 * time.Millisecond)
+
+	// the latest update is applied.
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	require.Equal(t, metricsRTMPServer(s2), m.rtmpServer)
+}
+
+func TestMetricsRTMPServerSetBothServers(t *testing.T) {
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+
+	m := &metrics{
+		ctx:              ctx,
+		ctxCancel:        ctxCancel,
+		chRTMPServerSet:  make(chan metricsRTMPServer, 1),
+		chRTMPSServerSet: make(chan metricsRTMPServer, 1),
+	}
+
+	rtmp := &rtmpServer{}
+	rtmps := &rtmpServer{isTLS: true}
+
+	// both servers register before the updates are applied.
+	m.rtmpServerSet(rtmp)
+	m.rtmpsServerSet(rtmps)
+
+	go m.runSet()
+	time.Sleep(100 * time.Millisecond)
+
+	// an update of a server doesn't overwrite the other one.
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	require.Equal(t, metricsRTMPServer(rtmp), m.rtmpServer)
+	require.Equal(t, metricsRTMPServer(rtmps), m.rtmpsServer)
+}
@@ -126,7 +126,7 @@ type pathDescribeReq struct {
 }
 
 type pathReaderSetupPlayRes struct {
-	path   *path
+	path   *path // filled even when err is pathErrNoOnePublishing
 	stream *stream
 	err    error
 }
@@ -135,6 +135,7 @@ type pathReaderAddReq struct {
 	author       reader
 	pathName     string
 	authenticate authenticateFunc
+	monitor      bool // passive reader, not counted by on-demand sources and limits
 	res          chan pathReaderSetupPlayRes
 }
 
@@ -223,6 +224,7 @@ type path struct {
 	source                         source
 	stream                         *stream
 	readers                        map[reader]pathReaderState
+	monitors                       map[reader]struct{}
 	describeRequestsOnHold         []pathDescribeReq
 	readerAddRequestsOnHold        []pathReaderAddReq
 	onDemandCmd                    *externalcmd.Cmd
@@ -231,6 +233,7 @@ type path struct {
 	onDemandStaticSourceReadyTimer *time.Timer
 	onDemandStaticSourceCloseTimer *time.Timer
 	onDemandPublisherState         pathOnDemandState
+	onDemandPublisher              publisher // publisher started by the runOnDemand command
 	onDemandPublisherReadyTimer    *time.Timer
 	onDemandPublisherCloseTimer    *time.Timer
 
@@ -280,6 +283,7 @@ func newPath(
 		ctx:                            ctx,
 		ctxCancel:                      ctxCancel,
 		readers:                        make(map[reader]pathReaderState),
+		monitors:                       make(map[reader]struct{}),
 		onDemandStaticSourceReadyTimer: newEmptyTimer(),
 		onDemandStaticSourceCloseTimer: newEmptyTimer(),
 		onDemandPublisherReadyTimer:    newEmptyTimer(),
@@ -348,6 +352,13 @@ func (pa *path) hasOnDemandPublisher() bool {
 	return pa.conf.RunOnDemand != ""
 }
 
+// isOnDemandPublisher returns whether a publisher has been started by the runOnDemand command.
+func (pa *path) isOnDemandPublisher(p publisher) bool {
+	return pa.onDemandPublisherState != pathOnDemandStateInitial &&
+		pa.onDemandPublisher != nil &&
+		p == pa.onDemandPublisher
+}
+
 func (pa *path) run() {
 	defer pa.wg.Done()
 
@@ -650,6 +661,7 @@ func (pa *path) onDemandPublisherStop() {
 
 	// set state before doPublisherRemove()
 	pa.onDemandPublisherState = pathOnDemandStateInitial
+	pa.onDemandPublisher = nil
 
 	if pa.source != nil {
 		pa.source.(publisher).close()
@@ -716,15 +728,21 @@ func (pa *path) doReaderRemove(r reader) {
 	}
 
 	delete(pa.readers, r)
+	delete(pa.monitors, r)
 }
 
 func (pa *path) doPublisherRemove() {
+	p, _ := pa.source.(publisher)
+
 	if pa.stream != nil {
-		if pa.hasOnDemandPublisher() && pa.onDemandPublisherState != pathOnDemandStateInitial {
+		if pa.isOnDemandPublisher(p) {
 			pa.onDemandPublisherStop()
 		} else {
 			pa.sourceSetNotReady()
 		}
+	} else if pa.isOnDemandPublisher(p) {
+		// the command may start another publisher.
+		pa.onDemandPublisher = nil
 	}
 
 	pa.source = nil
@@ -796,12 +814,35 @@ func (pa *path) handlePublisherAnnounce(req pathPublisherAddReq) {
 		return
 	}
 
-	if pa.source != nil {
-		if pa.conf.DisablePublisherOverride {
-			req.res <- pathPublisherAnnounceRes{err: fmt.Errorf("someone is already publishing to path '%s'", pa.name)}
-			return
+	if pa.source != nil && pa.conf.DisablePublisherOverride {
+		req.res <- pathPublisherAnnounceRes{err: fmt.Errorf("someone is already publishing to path '%s'", pa.name)}
+		return
+	}
+
+	if pa.hasOnDemandPublisher() && pa.onDemandPublisherState != pathOnDemandStateInitial {
+		if pa.onDemandPublisher == nil {
+			// the command is running and none of its publishers has announced yet.
+			// Publishers can't be told apart, therefore the first one is considered
+			// the one started by the command.
+			pa.onDemandPublisher = req.author
+		} else {
+			if pa.conf.RunOnDemandPolicy == conf.OnDemandPolicyOnDemand {
+				req.res <- pathPublisherAnnounceRes{
+					err: fmt.Errorf("path '%s' is being published by its runOnDemand command", pa.name),
+				}
+				return
+			}
+
+			// stop the command, otherwise it would restart and
+			// fight with the new publisher.
+			pa.log(logger.Info, "a publisher is taking over the path, stopping runOnDemand command")
+			pa.onDemandPublisherReadyTimer.Stop()
+			pa.onDemandPublisherReadyTimer = newEmptyTimer()
+			pa.onDemandPublisherStop()
 		}
+	}
 
+	if pa.source != nil {
 		pa.log(logger.Info, "closing existing publisher")
 		pa.source.(publisher).close()
 		pa.doPublisherRemove()
@@ -825,10 +866,14 @@ func (pa *path) handlePublisherRecord(req pathPublisherStartReq) {
 	}
 
 	if pa.hasOnDemandPublisher() {
-		pa.onDemandPublisherReadyTimer.Stop()
-		pa.onDemandPublisherReadyTimer = newEmptyTimer()
+		// publishers that are not started by the command are not
+		// subject to the on-demand lifecycle.
+		if pa.isOnDemandPublisher(req.author) {
+			pa.onDemandPublisherReadyTimer.Stop()
+			pa.onDemandPublisherReadyTimer = newEmptyTimer()
 
-		pa.onDemandPublisherScheduleClose()
+			pa.onDemandPublisherScheduleClose()
+		}
 
 		for _, req := range pa.describeRequestsOnHold {
 			req.res <- pathDescribeRes{
@@ -848,7 +893,7 @@ func (pa *path) handlePublisherRecord(req pathPublisherStartReq) {
 
 func (pa *path) handlePublisherPause(req pathPublisherStopReq) {
 	if req.author == pa.source && pa.stream != nil {
-		if pa.hasOnDemandPublisher() && pa.onDemandPublisherState != pathOnDemandStateInitial {
+		if pa.isOnDemandPublisher(req.author) {
 			pa.onDemandPublisherStop()
 		} else {
 			pa.sourceSetNotReady()
@@ -863,7 +908,7 @@ func (pa *path) handleReaderRemove(req pathReaderRemoveReq) {
 	}
 	close(req.res)
 
-	if len(pa.readers) == 0 {
+	if (len(pa.readers) - len(pa.monitors)) == 0 {
 		if pa.hasOnDemandStaticSource() {
 			if pa.onDemandStaticSourceState == pathOnDemandStateReady {
 				pa.onDemandStaticSourceScheduleClose()
@@ -882,6 +927,15 @@ func (pa *path) handleReaderSetupPlay(req pathReaderAddReq) {
 		return
 	}
 
+	// monitors never start on-demand sources.
+	if req.monitor {
+		req.res <- pathReaderSetupPlayRes{
+			path: pa,
+			err:  pathErrNoOnePublishing{pathName: pa.name},
+		}
+		return
+	}
+
 	if pa.hasOnDemandStaticSource() {
 		if pa.onDemandStaticSourceState == pathOnDemandStateInitial {
 			pa.onDemandStaticSourceStart()
@@ -898,13 +952,27 @@ func (pa *path) handleReaderSetupPlay(req pathReaderAddReq) {
 		return
 	}
 
-	req.res <- pathReaderSetupPlayRes{err: pathErrNoOnePublishing{pathName: pa.name}}
+	req.res <- pathReaderSetupPlayRes{
+		path: pa,
+		err:  pathErrNoOnePublishing{pathName: pa.name},
+	}
 }
 
 func (pa *path) handleReaderSetupPlayPost(req pathReaderAddReq) {
+	if _, ok := req.author.(*rtmpConn); ok && !req.monitor && pa.conf.RTMPMaxReaders != 0 &&
+		pa.rtmpReadersCount() >= pa.conf.RTMPMaxReaders {
+		req.res <- pathReaderSetupPlayRes{
+			err: fmt.Errorf("path '%s' reached the maximum number of RTMP readers (%d)",
+				pa.name, pa.conf.RTMPMaxReaders),
+		}
+		return
+	}
+
 	pa.readers[req.author] = pathReaderStatePrePlay
 
-	if pa.hasOnDemandStaticSource() {
+	if req.monitor {
+		pa.monitors[req.author] = struct{}{}
+	} else if pa.hasOnDemandStaticSource() {
 		if pa.onDemandStaticSourceState == pathOnDemandStateClosing {
 			pa.onDemandStaticSourceState = pathOnDemandStateReady
 			pa.onDemandStaticSourceCloseTimer.Stop()
@@ -924,6 +992,19 @@ func (pa *path) handleReaderSetupPlayPost(req pathReaderAddReq) {
 	}
 }
 
+func (pa *path) rtmpReadersCount() int {
+	n := 0
+	for r := range pa.readers {
+		if _, ok := pa.monitors[r]; ok {
+			continue
+		}
+		if _, ok := r.(*rtmpConn); ok {
+			n++
+		}
+	}
+	return n
+}
+
 func (pa *path) handleReaderPlay(req pathReaderStartReq) {
 	pa.readers[req.author] = pathReaderStatePlay
 
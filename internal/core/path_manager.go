@@ -19,6 +19,11 @@ type pathManagerParent interface {
 	Log(logger.Level, string, ...interface{})
 }
 
+type pathManagerTimeoutsReloadReq struct {
+	readTimeout  conf.StringDuration
+	writeTimeout conf.StringDuration
+}
+
 type pathManager struct {
 	rtspAddress     string
 	readTimeout     conf.StringDuration
@@ -37,6 +42,7 @@ type pathManager struct {
 
 	// in
 	chConfReload         chan map[string]*conf.PathConf
+	chTimeoutsReload     chan pathManagerTimeoutsReloadReq
 	chPathClose          chan *path
 	chPathSourceReady    chan *path
 	chPathSourceNotReady chan *path
@@ -73,6 +79,7 @@ func newPathManager(
 		ctxCancel:            ctxCancel,
 		paths:                make(map[string]*path),
 		chConfReload:         make(chan map[string]*conf.PathConf),
+		chTimeoutsReload:     make(chan pathManagerTimeoutsReloadReq),
 		chPathClose:          make(chan *path),
 		chPathSourceReady:    make(chan *path),
 		chPathSourceNotReady: make(chan *path),
@@ -156,6 +163,25 @@ outer:
 				}
 			}
 
+		case req := <-pm.chTimeoutsReload:
+			pm.readTimeout = req.readTimeout
+			pm.writeTimeout = req.writeTimeout
+
+			// timeouts are used by static sources only: recreate paths
+			// that have one, leave the others (and their publishers) alone.
+			for _, pa := range pm.paths {
+				if pa.hasStaticSource() {
+					delete(pm.paths, pa.Name())
+					pa.close()
+				}
+			}
+
+			for pathConfName, pathConf := range pm.pathConfs {
+				if _, ok := pm.paths[pathConfName]; !ok && pathConf.Regexp == nil {
+					pm.createPath(pathConfName, pathConf, pathConfName, nil)
+				}
+			}
+
 		case pa := <-pm.chPathClose:
 			if pmpa, ok := pm.paths[pa.Name()]; !ok || pmpa != pa {
 				continue
@@ -323,6 +349,17 @@ func (pm *pathManager) confReload(pathConfs map[string]*conf.PathConf) {
 	}
 }
 
+// timeoutsReload is called by core.
+func (pm *pathManager) timeoutsReload(readTimeout conf.StringDuration, writeTimeout conf.StringDuration) {
+	select {
+	case pm.chTimeoutsReload <- pathManagerTimeoutsReloadReq{
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+	}:
+	case <-pm.ctx.Done():
+	}
+}
+
 // pathSourceReady is called by path.
 func (pm *pathManager) pathSourceReady(pa *path) {
 	select {
@@ -2,12 +2,16 @@ package core
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/url"
+	gopath "path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aler9/gortsplib"
@@ -27,8 +31,28 @@ import (
 
 const (
 	rtmpConnPauseAfterAuthError = 2 * time.Second
+
+	// period between attempts to read from a path that has no publisher.
+	rtmpConnWaitPublisherPeriod = 500 * time.Millisecond
+
+	// prefix of the lines printed by runOnConnect that set a label.
+	rtmpConnLabelPrefix = "RTSP_LABEL "
+
+	rtmpConnMaxLabels = 32
+
+	// the inbound bitrate of publishers is sampled with this period
+	// and averaged over this window.
+	rtmpConnBitratePeriod = 1 * time.Second
+	rtmpConnBitrateWindow = 5 * time.Second
+
+	// chunk size set by rtmp.Conn.InitializeServer().
+	rtmpConnDefaultWriteChunkSize = 65536
 )
 
+// rtmpConnKeepaliveData is pushed into the queue of readers in order to
+// make the read loop send a ping.
+var rtmpConnKeepaliveData = &data{}
+
 func pathNameAndQuery(inURL *url.URL) (string, url.Values, string) {
 	// remove leading and trailing slashes inserted by OBS and some other clients
 	tmp := strings.TrimRight(inURL.String(), "/")
@@ -37,12 +61,108 @@ func pathNameAndQuery(inURL *url.URL) (string, url.Values, string) {
 	return pathName, ur.Query(), ur.RawQuery
 }
 
+// rtmpConnNetConn wraps the net.Conn of a rtmpConn in order to count transferred bytes
+// and to measure write durations.
+type rtmpConnNetConn struct {
+	bytesReceived uint64 // first for 64-bit alignment
+	bytesSent     uint64
+	writeDuration int64 // rolling average, in nanoseconds
+	net.Conn
+}
+
+// Read implements net.Conn.
+func (c *rtmpConnNetConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddUint64(&c.bytesReceived, uint64(n))
+	return n, err
+}
+
+// Write implements net.Conn.
+func (c *rtmpConnNetConn) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := c.Conn.Write(p)
+	atomic.AddUint64(&c.bytesSent, uint64(n))
+
+	// writes are performed by a single routine, therefore there's no need of a CAS
+	avg := atomic.LoadInt64(&c.writeDuration)
+	atomic.StoreInt64(&c.writeDuration, avg+(int64(time.Since(start))-avg)/8)
+
+	return n, err
+}
+
 type rtmpConnState int
 
 const (
-	rtmpConnStateIdle rtmpConnState = iota //nolint:deadcode,varcheck
+	rtmpConnStateIdle rtmpConnState = iota
 	rtmpConnStateRead
 	rtmpConnStatePublish
+	rtmpConnStateAuth
+	rtmpConnStateMonitor
+)
+
+// reasons why a connection has been closed.
+const (
+	rtmpConnCloseReasonNormal          = "normal"
+	rtmpConnCloseReasonKicked          = "kicked"
+	rtmpConnCloseReasonTimeout         = "timeout"
+	rtmpConnCloseReasonError           = "error"
+	rtmpConnCloseReasonTerminated      = "terminated"
+	rtmpConnCloseReasonBitrateExceeded = "bitrateExceeded"
+)
+
+// rtmpConnErrTerminated is returned when the connection is closed by the server.
+var rtmpConnErrTerminated = errors.New("terminated")
+
+// rtmpConnErrBitrateExceeded is returned when the bitrate of a publisher
+// exceeds the maximum allowed by the path.
+type rtmpConnErrBitrateExceeded struct {
+	bitrate uint64
+	max     uint64
+}
+
+// Error implements the error interface.
+func (e rtmpConnErrBitrateExceeded) Error() string {
+	return fmt.Sprintf("bitrate exceeded (%d bit/s, maximum is %d bit/s)", e.bitrate, e.max)
+}
+
+type rtmpConnBitrateSample struct {
+	t     time.Time
+	bytes uint64
+}
+
+// rtmpConnBitrateMeter measures a bitrate over a rolling window.
+type rtmpConnBitrateMeter struct {
+	window  time.Duration
+	samples []rtmpConnBitrateSample
+}
+
+// sample adds the current value of a byte counter and returns the bitrate
+// over the window, in bits per second. It returns false until the window is full.
+func (m *rtmpConnBitrateMeter) sample(now time.Time, bytes uint64) (uint64, bool) {
+	m.samples = append(m.samples, rtmpConnBitrateSample{now, bytes})
+
+	// remove samples that are not needed to cover the window
+	for len(m.samples) > 2 && now.Sub(m.samples[1].t) >= m.window {
+		m.samples = m.samples[1:]
+	}
+
+	first := m.samples[0]
+	elapsed := now.Sub(first.t)
+	if elapsed < m.window {
+		return 0, false
+	}
+
+	return uint64(float64(bytes-first.bytes) * 8 / elapsed.Seconds()), true
+}
+
+// modes of RTMP readers, selected with the readMode query parameter.
+const (
+	// frames are dropped when the reader is too slow (default).
+	rtmpConnReadModeLatency = "latency"
+
+	// frames are never dropped, slow readers slow down the publisher
+	// and are closed when they can't receive frames within writeTimeout.
+	rtmpConnReadModeReliable = "reliable"
 )
 
 type rtmpConnPathManager interface {
@@ -52,33 +172,61 @@ type rtmpConnPathManager interface {
 
 type rtmpConnParent interface {
 	log(logger.Level, string, ...interface{})
+	connLogEnabled(logger.Level) bool
+	connStateChange(*rtmpConn)
+	connHandshakeDone(time.Duration)
 	connClose(*rtmpConn)
+	connPublish(*rtmpConn, string)
+	connUnpublish(*rtmpConn, string)
 }
 
 type rtmpConn struct {
+	lastDataPulled            int64 // first for 64-bit alignment, in unix nanoseconds
 	isTLS                     bool
 	id                        string
 	externalAuthenticationURL string
+	publishTokenValidator     rtmpPublishTokenValidator
+	allowedPaths              conf.PathPatterns
 	rtspAddress               string
 	readTimeout               conf.StringDuration
 	writeTimeout              conf.StringDuration
+	handshakeTimeout          conf.StringDuration
+	writeChunkSize            int
+	waitPublisher             conf.StringDuration
+	readerKeepalive           conf.StringDuration
 	readBufferCount           int
 	runOnConnect              string
 	runOnConnectRestart       bool
-	wg                        *sync.WaitGroup
+	runOnDisconnect           string
+	wg                        *rtmpServerWaitGroup
 	conn                      *rtmp.Conn
-	nconn                     net.Conn
+	nconn                     *rtmpConnNetConn
 	externalCmdPool           *externalcmd.Pool
 	pathManager               rtmpConnPathManager
 	parent                    rtmpConnParent
 
-	ctx        context.Context
-	ctxCancel  func()
-	created    time.Time
-	path       *path
-	ringBuffer *ringbuffer.RingBuffer // read
-	state      rtmpConnState
-	stateMutex sync.Mutex
+	ctx            context.Context
+	ctxCancel      func()
+	created        time.Time
+	path           *path
+	ringBuffer     *ringbuffer.RingBuffer // read, latency mode
+	readQueue      chan *data             // read, reliable mode
+	readQueueDone  chan struct{}          // read, reliable mode
+	readMode       string
+	state          rtmpConnState
+	stateChanged   time.Time
+	clientSoftware string
+	tlsVersion     string
+	tlsCipherSuite string
+	closeReason    string
+	labels         map[string]string
+	stateMutex     sync.Mutex
+
+	// in
+	chHandoff chan *url.URL
+
+	// out
+	done chan struct{}
 }
 
 func newRTMPConn(
@@ -86,13 +234,20 @@ func newRTMPConn(
 	isTLS bool,
 	id string,
 	externalAuthenticationURL string,
+	publishTokenValidator rtmpPublishTokenValidator,
+	allowedPaths conf.PathPatterns,
 	rtspAddress string,
 	readTimeout conf.StringDuration,
 	writeTimeout conf.StringDuration,
+	handshakeTimeout conf.StringDuration,
+	writeChunkSize int,
+	waitPublisher conf.StringDuration,
+	readerKeepalive conf.StringDuration,
 	readBufferCount int,
 	runOnConnect string,
 	runOnConnectRestart bool,
-	wg *sync.WaitGroup,
+	runOnDisconnect string,
+	wg *rtmpServerWaitGroup,
 	nconn net.Conn,
 	externalCmdPool *externalcmd.Pool,
 	pathManager rtmpConnPathManager,
@@ -100,26 +255,38 @@ func newRTMPConn(
 ) *rtmpConn {
 	ctx, ctxCancel := context.WithCancel(parentCtx)
 
+	cnconn := &rtmpConnNetConn{Conn: nconn}
+
 	c := &rtmpConn{
 		isTLS:                     isTLS,
 		id:                        id,
 		externalAuthenticationURL: externalAuthenticationURL,
+		publishTokenValidator:     publishTokenValidator,
+		allowedPaths:              allowedPaths,
 		rtspAddress:               rtspAddress,
 		readTimeout:               readTimeout,
 		writeTimeout:              writeTimeout,
+		handshakeTimeout:          handshakeTimeout,
+		writeChunkSize:            writeChunkSize,
+		waitPublisher:             waitPublisher,
+		readerKeepalive:           readerKeepalive,
 		readBufferCount:           readBufferCount,
 		runOnConnect:              runOnConnect,
 		runOnConnectRestart:       runOnConnectRestart,
+		runOnDisconnect:           runOnDisconnect,
 		wg:                        wg,
-		conn:                      rtmp.NewConn(nconn),
-		nconn:                     nconn,
+		conn:                      rtmp.NewConn(cnconn),
+		nconn:                     cnconn,
 		externalCmdPool:           externalCmdPool,
 		pathManager:               pathManager,
 		parent:                    parent,
 		ctx:                       ctx,
 		ctxCancel:                 ctxCancel,
 		created:                   time.Now(),
+		chHandoff:                 make(chan *url.URL, 1),
+		done:                      make(chan struct{}),
 	}
+	c.stateChanged = c.created
 
 	c.log(logger.Info, "opened")
 
@@ -133,39 +300,256 @@ func (c *rtmpConn) close() {
 	c.ctxCancel()
 }
 
+// handoff asks a publisher to reconnect to another server.
+// The request is sent by the connection routine when the next message is received.
+func (c *rtmpConn) handoff(successor *url.URL) {
+	select {
+	case c.chHandoff <- successor:
+	default:
+	}
+}
+
+// closeWithReason closes the connection and records why it was closed.
+func (c *rtmpConn) closeWithReason(reason string) {
+	c.stateMutex.Lock()
+	if c.closeReason == "" {
+		c.closeReason = reason
+	}
+	c.stateMutex.Unlock()
+
+	c.close()
+}
+
 func (c *rtmpConn) remoteAddr() net.Addr {
 	return c.nconn.RemoteAddr()
 }
 
 func (c *rtmpConn) log(level logger.Level, format string, args ...interface{}) {
-	c.parent.log(level, "[conn %v] "+format, append([]interface{}{c.nconn.RemoteAddr()}, args...)...)
+	if !c.parent.connLogEnabled(level) {
+		return
+	}
+	c.parent.log(level, "[conn %s %v] "+format, append([]interface{}{c.id, c.nconn.RemoteAddr()}, args...)...)
 }
 
 func (c *rtmpConn) ip() net.IP {
 	return c.nconn.RemoteAddr().(*net.TCPAddr).IP
 }
 
+func (c *rtmpConn) bytesReceived() uint64 {
+	return atomic.LoadUint64(&c.nconn.bytesReceived)
+}
+
+func (c *rtmpConn) bytesSent() uint64 {
+	return atomic.LoadUint64(&c.nconn.bytesSent)
+}
+
+func (c *rtmpConn) writeDuration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.nconn.writeDuration))
+}
+
 func (c *rtmpConn) safeState() rtmpConnState {
 	c.stateMutex.Lock()
 	defer c.stateMutex.Unlock()
 	return c.state
 }
 
+func (c *rtmpConn) setState(state rtmpConnState) {
+	c.stateMutex.Lock()
+	c.state = state
+	c.stateChanged = time.Now()
+	c.stateMutex.Unlock()
+
+	c.parent.connStateChange(c)
+}
+
+func (c *rtmpConn) safeStateSince() (rtmpConnState, time.Time) {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	return c.state, c.stateChanged
+}
+
+func (c *rtmpConn) safePathName() string {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	if c.path == nil {
+		return ""
+	}
+	return c.path.Name()
+}
+
+// isEncrypted returns whether the connection is encrypted.
+func (c *rtmpConn) isEncrypted() bool {
+	_, ok := c.nconn.Conn.(*tls.Conn)
+	return ok
+}
+
+// safeTLSState returns the negotiated TLS version and cipher suite.
+// They are empty until the handshake has been completed.
+func (c *rtmpConn) safeTLSState() (string, string) {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	return c.tlsVersion, c.tlsCipherSuite
+}
+
+func rtmpConnTLSVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", v)
+}
+
+func (c *rtmpConn) safeCloseReason() string {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	return c.closeReason
+}
+
+// setCloseReason fills the close reason from the error that terminated the connection,
+// unless a reason was already provided by closeWithReason.
+func (c *rtmpConn) setCloseReason(err error) string {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+
+	if c.closeReason == "" {
+		c.closeReason = rtmpConnCloseReason(err)
+	}
+	return c.closeReason
+}
+
+// rtmpConnCloseReason returns the close reason that corresponds to an error.
+func rtmpConnCloseReason(err error) string {
+	if errors.Is(err, io.EOF) {
+		return rtmpConnCloseReasonNormal
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return rtmpConnCloseReasonTimeout
+	}
+
+	if errors.Is(err, rtmpConnErrTerminated) {
+		return rtmpConnCloseReasonTerminated
+	}
+
+	if _, ok := err.(rtmpConnErrBitrateExceeded); ok {
+		return rtmpConnCloseReasonBitrateExceeded
+	}
+
+	return rtmpConnCloseReasonError
+}
+
+// safeLabels returns a copy of the labels set by runOnConnect.
+func (c *rtmpConn) safeLabels() map[string]string {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+
+	ret := make(map[string]string, len(c.labels))
+	for k, v := range c.labels {
+		ret[k] = v
+	}
+	return ret
+}
+
+// onConnectOutput is called with every line printed by runOnConnect.
+// Lines in the format "RTSP_LABEL key=value" set a label, an empty value removes it.
+func (c *rtmpConn) onConnectOutput(line string) {
+	key, value, ok := rtmpConnParseLabel(line)
+	if !ok {
+		return
+	}
+
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+
+	if value == "" {
+		delete(c.labels, key)
+		return
+	}
+
+	if _, ok := c.labels[key]; !ok && len(c.labels) >= rtmpConnMaxLabels {
+		return
+	}
+
+	if c.labels == nil {
+		c.labels = make(map[string]string)
+	}
+	c.labels[key] = value
+}
+
+// rtmpConnPathAllowed returns whether a path name matches one of the allowed patterns.
+// An empty list allows all paths.
+func rtmpConnPathAllowed(pathName string, allowedPaths conf.PathPatterns) bool {
+	if len(allowedPaths) == 0 {
+		return true
+	}
+
+	for _, pattern := range allowedPaths {
+		if ok, _ := gopath.Match(pattern, pathName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func rtmpConnParseLabel(line string) (string, string, bool) {
+	if !strings.HasPrefix(line, rtmpConnLabelPrefix) {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(line[len(rtmpConnLabelPrefix):], "=", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+
+	key := strings.TrimSpace(parts[0])
+	if key == "" {
+		return "", "", false
+	}
+
+	return key, strings.TrimSpace(parts[1]), true
+}
+
+func (c *rtmpConn) safeReadMode() string {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	return c.readMode
+}
+
+func (c *rtmpConn) safeClientSoftware() string {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	return c.clientSoftware
+}
+
 func (c *rtmpConn) run() {
 	defer c.wg.Done()
+	defer close(c.done)
 
 	err := func() error {
 		if c.runOnConnect != "" {
 			c.log(logger.Info, "runOnConnect command started")
 			_, port, _ := net.SplitHostPort(c.rtspAddress)
-			onConnectCmd := externalcmd.NewCmd(
+			onConnectCmd := externalcmd.NewCmdWithOutput(
 				c.externalCmdPool,
 				c.runOnConnect,
 				c.runOnConnectRestart,
 				externalcmd.Environment{
-					"RTSP_PATH": "",
-					"RTSP_PORT": port,
+					"RTSP_PATH":             "",
+					"RTSP_PORT":             port,
+					"RTSP_RTMP_CONN_ID":     c.id,
+					"RTSP_RTMP_REMOTE_ADDR": c.nconn.RemoteAddr().String(),
 				},
+				c.onConnectOutput,
 				func(co int) {
 					c.log(logger.Info, "runOnConnect command exited with code %d", co)
 				})
@@ -190,15 +574,50 @@ func (c *rtmpConn) run() {
 		case <-c.ctx.Done():
 			cancel()
 			<-runErr
-			return errors.New("terminated")
+			return rtmpConnErrTerminated
 		}
 	}()
 
 	c.ctxCancel()
 
+	reason := c.setCloseReason(err)
+
 	c.parent.connClose(c)
 
-	c.log(logger.Info, "closed (%v)", err)
+	// the error is logged only when it says more than the reason.
+	if errors.Is(err, rtmpConnErrTerminated) || errors.Is(err, io.EOF) {
+		c.log(logger.Info, "closed, reason: %s", reason)
+	} else {
+		c.log(logger.Info, "closed (%v), reason: %s", err, reason)
+	}
+
+	if c.runOnDisconnect != "" {
+		c.log(logger.Info, "runOnDisconnect command launched")
+		_, port, _ := net.SplitHostPort(c.rtspAddress)
+		exited := make(chan struct{})
+		onDisconnectCmd := externalcmd.NewCmd(
+			c.externalCmdPool,
+			c.runOnDisconnect,
+			false,
+			externalcmd.Environment{
+				"RTSP_PATH":              "",
+				"RTSP_PORT":              port,
+				"RTSP_RTMP_CONN_ID":      c.id,
+				"RTSP_RTMP_REMOTE_ADDR":  c.nconn.RemoteAddr().String(),
+				"RTSP_RTMP_STATE":        rtmpServerAPIConnState(c.safeState()),
+				"RTSP_RTMP_CLOSE_REASON": reason,
+			},
+			func(co int) {
+				c.log(logger.Info, "runOnDisconnect command exited with code %d", co)
+				close(exited)
+			})
+
+		// the command is not restarted, release it as soon as it exits.
+		go func() {
+			<-exited
+			onDisconnectCmd.Close()
+		}()
+	}
 }
 
 func (c *rtmpConn) runInner(ctx context.Context) error {
@@ -207,23 +626,55 @@ func (c *rtmpConn) runInner(ctx context.Context) error {
 		c.nconn.Close()
 	}()
 
-	c.nconn.SetReadDeadline(time.Now().Add(time.Duration(c.readTimeout)))
-	c.nconn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+	handshakeTimeout := c.handshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = c.readTimeout
+	}
+
+	c.nconn.SetReadDeadline(time.Now().Add(time.Duration(handshakeTimeout)))
+	c.nconn.SetWriteDeadline(time.Now().Add(time.Duration(handshakeTimeout)))
 	u, isPublishing, err := c.conn.InitializeServer()
 	if err != nil {
 		return err
 	}
 
+	c.nconn.SetReadDeadline(time.Now().Add(time.Duration(c.readTimeout)))
+	c.nconn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+
+	c.stateMutex.Lock()
+	c.clientSoftware = c.conn.FlashVer()
+	if tconn, ok := c.nconn.Conn.(*tls.Conn); ok {
+		// the handshake has been completed by InitializeServer().
+		cs := tconn.ConnectionState()
+		c.tlsVersion = rtmpConnTLSVersionName(cs.Version)
+		c.tlsCipherSuite = tls.CipherSuiteName(cs.CipherSuite)
+	}
+	c.stateMutex.Unlock()
+
+	// reject paths that are not allowed before creating them.
+	pathName, _, _ := pathNameAndQuery(u)
+	if !rtmpConnPathAllowed(pathName, c.allowedPaths) {
+		c.log(logger.Info, "path '%s' is not allowed", pathName)
+		return fmt.Errorf("path not allowed")
+	}
+
 	if !isPublishing {
 		return c.runRead(ctx, u)
 	}
 	return c.runPublish(ctx, u)
 }
 
-func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
-	pathName, query, rawQuery := pathNameAndQuery(u)
+// newReaderAddReq returns a request that adds the connection to a path as a reader.
+func (c *rtmpConn) newReaderAddReq(
+	pathName string,
+	monitor bool,
+	query url.Values,
+	rawQuery string,
+) pathReaderAddReq {
+	// credentials are checked once, not every time the request is repeated.
+	authenticated := false
 
-	res := c.pathManager.readerAdd(pathReaderAddReq{
+	return pathReaderAddReq{
 		author:   c,
 		pathName: pathName,
 		authenticate: func(
@@ -231,12 +682,179 @@ func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
 			pathUser conf.Credential,
 			pathPass conf.Credential,
 		) error {
-			return c.authenticate(pathName, pathIPs, pathUser, pathPass, false, query, rawQuery)
+			if authenticated {
+				return nil
+			}
+			err := c.authenticate(pathName, pathIPs, pathUser, pathPass, false, query, rawQuery)
+			authenticated = (err == nil)
+			return err
 		},
+		monitor: monitor,
+	}
+}
+
+// readerAdd adds the connection to a path as a reader. If no one is publishing
+// to the path, the request is either rejected or, when waitPublisher is set,
+// repeated until a publisher shows up.
+func (c *rtmpConn) readerAdd(ctx context.Context, req pathReaderAddReq) (pathReaderSetupPlayRes, error) {
+	res := c.pathManager.readerAdd(req)
+
+	if _, ok := res.err.(pathErrNoOnePublishing); !ok || c.waitPublisher == 0 {
+		return res, nil
+	}
+
+	c.log(logger.Debug, "waiting for a publisher on path '%s'", req.pathName)
+
+	timeout := time.NewTimer(time.Duration(c.waitPublisher))
+	defer timeout.Stop()
+
+	t := time.NewTicker(rtmpConnWaitPublisherPeriod)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			res = c.pathManager.readerAdd(req)
+			if _, ok := res.err.(pathErrNoOnePublishing); !ok {
+				return res, nil
+			}
+
+		case <-timeout.C:
+			return res, nil
+
+		case <-ctx.Done():
+			return res, rtmpConnErrTerminated
+		}
+	}
+}
+
+// overrideChunkSize sets the chunk size of outgoing messages.
+// The connect negotiation sets the default chunk size, since it takes place
+// before knowing whether the client reads or publishes.
+func (c *rtmpConn) overrideChunkSize() error {
+	if c.writeChunkSize == rtmpConnDefaultWriteChunkSize {
+		return nil
+	}
+
+	return c.conn.WriteMessage(&message.MsgSetChunkSize{
+		Value: uint32(c.writeChunkSize),
 	})
+}
+
+// readFallback sends a file to the client in a loop, until a publisher is available.
+// It returns the result of the reader request and the DTS of the last message sent.
+func (c *rtmpConn) readFallback(
+	ctx context.Context,
+	req pathReaderAddReq,
+	fpath string,
+) (pathReaderSetupPlayRes, time.Duration, error) {
+	r, err := newRTMPFallbackReader(fpath)
+	if err != nil {
+		return pathReaderSetupPlayRes{}, 0, err
+	}
+	defer r.close()
+
+	c.setState(rtmpConnStateRead)
+
+	c.log(logger.Info, "is reading fallback file '%s' while waiting for a publisher on path '%s'",
+		fpath, req.pathName)
+
+	c.nconn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+	err = c.overrideChunkSize()
+	if err != nil {
+		return pathReaderSetupPlayRes{}, 0, err
+	}
+
+	// disable read deadline
+	c.nconn.SetReadDeadline(time.Time{})
+
+	t := time.NewTicker(rtmpConnWaitPublisherPeriod)
+	defer t.Stop()
+
+	start := time.Now()
+	var lastDTS time.Duration
+
+	for {
+		msg, dts, err := r.next()
+		if err != nil {
+			return pathReaderSetupPlayRes{}, 0, fmt.Errorf("unable to read fallback file: %s", err)
+		}
+
+		// messages are sent with the pace given by their timestamps.
+		pace := time.NewTimer(time.Until(start.Add(dts)))
+
+	wait:
+		for {
+			select {
+			case <-pace.C:
+				break wait
+
+			case <-t.C:
+				res := c.pathManager.readerAdd(req)
+				if _, ok := res.err.(pathErrNoOnePublishing); !ok {
+					pace.Stop()
+					c.log(logger.Info, "a publisher is available, leaving fallback file")
+					return res, lastDTS, nil
+				}
+
+			case <-ctx.Done():
+				pace.Stop()
+				return pathReaderSetupPlayRes{}, 0, rtmpConnErrTerminated
+			}
+		}
+
+		c.nconn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+		err = c.conn.WriteMessage(msg)
+		if err != nil {
+			return pathReaderSetupPlayRes{}, 0, err
+		}
+
+		lastDTS = dts
+	}
+}
+
+func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
+	pathName, query, rawQuery := pathNameAndQuery(u)
+
+	// monitors receive the stream without being counted as readers.
+	monitor := query.Get("monitor") == "1"
+
+	readMode := query.Get("readMode")
+	switch readMode {
+	case "":
+		readMode = rtmpConnReadModeLatency
+
+	case rtmpConnReadModeLatency, rtmpConnReadModeReliable:
+
+	default:
+		return fmt.Errorf("invalid read mode: %s", readMode)
+	}
+
+	req := c.newReaderAddReq(pathName, monitor, query, rawQuery)
+
+	res, err := c.readerAdd(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	// timestamps of the stream are shifted after the ones of the fallback file.
+	var dtsOffset time.Duration
+
+	if _, ok := res.err.(pathErrNoOnePublishing); ok && !monitor && res.path.Conf().RTMPFallbackFile != "" {
+		var lastDTS time.Duration
+		res, lastDTS, err = c.readFallback(ctx, req, res.path.Conf().RTMPFallbackFile)
+		if err != nil {
+			return err
+		}
+		dtsOffset = lastDTS + rtmpFallbackLoopGap
+	}
 
 	if res.err != nil {
 		if terr, ok := res.err.(pathErrAuthCritical); ok {
+			c.setState(rtmpConnStateAuth)
+
+			c.log(logger.Info, "authentication failed: %s", terr.message)
+
 			// wait some seconds to stop brute force attacks
 			<-time.After(rtmpConnPauseAfterAuthError)
 			return errors.New(terr.message)
@@ -244,15 +862,21 @@ func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
 		return res.err
 	}
 
+	c.stateMutex.Lock()
 	c.path = res.path
+	c.stateMutex.Unlock()
 
 	defer func() {
 		c.path.readerRemove(pathReaderRemoveReq{author: c})
 	}()
 
-	c.stateMutex.Lock()
-	c.state = rtmpConnStateRead
-	c.stateMutex.Unlock()
+	if monitor {
+		c.setState(rtmpConnStateMonitor)
+	} else {
+		c.setState(rtmpConnStateRead)
+	}
+
+	c.parent.connHandshakeDone(time.Since(c.created))
 
 	var videoTrack *gortsplib.TrackH264
 	videoTrackID := -1
@@ -291,21 +915,46 @@ func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
 		return fmt.Errorf("the stream doesn't contain an H264 track or an AAC track")
 	}
 
-	c.ringBuffer, _ = ringbuffer.New(uint64(c.readBufferCount))
-	go func() {
-		<-ctx.Done()
-		c.ringBuffer.Close()
-	}()
+	c.stateMutex.Lock()
+	c.readMode = readMode
+	c.stateMutex.Unlock()
+
+	if readMode == rtmpConnReadModeReliable {
+		c.readQueue = make(chan *data, c.readBufferCount)
+		c.readQueueDone = make(chan struct{})
+
+		// this is called before the reader is removed from the path,
+		// in order to unblock onReaderData().
+		defer close(c.readQueueDone)
+	} else {
+		c.ringBuffer, _ = ringbuffer.New(uint64(c.readBufferCount))
+		go func() {
+			<-ctx.Done()
+			c.ringBuffer.Close()
+		}()
+	}
+
+	if c.readerKeepalive != 0 {
+		atomic.StoreInt64(&c.lastDataPulled, time.Now().UnixNano())
+		go c.runReaderKeepalive(ctx)
+	}
 
 	c.path.readerStart(pathReaderStartReq{
 		author: c,
 	})
 
-	c.log(logger.Info, "is reading from path '%s', %s",
-		c.path.Name(),
-		sourceTrackInfo(res.stream.tracks()))
+	// the query, which may carry credentials, is never part of the path name
+	if monitor {
+		c.log(logger.Info, "is monitoring path '%s', %s",
+			c.path.Name(),
+			sourceTrackInfo(res.stream.tracks()))
+	} else {
+		c.log(logger.Info, "is reading from path '%s', %s",
+			c.path.Name(),
+			sourceTrackInfo(res.stream.tracks()))
+	}
 
-	if c.path.Conf().RunOnRead != "" {
+	if c.path.Conf().RunOnRead != "" && !monitor {
 		c.log(logger.Info, "runOnRead command started")
 		onReadCmd := externalcmd.NewCmd(
 			c.externalCmdPool,
@@ -321,7 +970,16 @@ func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
 		}()
 	}
 
-	err := c.conn.WriteTracks(videoTrack, audioTrack)
+	// deadlines set after the handshake may have expired while waiting for the path,
+	// refresh them so that they apply to single operations only.
+	c.nconn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+
+	err = c.overrideChunkSize()
+	if err != nil {
+		return err
+	}
+
+	err = c.conn.WriteTracks(videoTrack, audioTrack)
 	if err != nil {
 		return err
 	}
@@ -335,11 +993,25 @@ func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
 	var videoDTSExtractor *h264.DTSExtractor
 
 	for {
-		item, ok := c.ringBuffer.Pull()
+		data, ok := c.pullData(ctx)
 		if !ok {
-			return fmt.Errorf("terminated")
+			return rtmpConnErrTerminated
+		}
+
+		if data == rtmpConnKeepaliveData {
+			c.nconn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+			err := c.conn.WriteMessage(&message.MsgUserControlPingRequest{
+				ServerTime: uint32(time.Since(c.created) / time.Millisecond),
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if c.readerKeepalive != 0 {
+			atomic.StoreInt64(&c.lastDataPulled, time.Now().UnixNano())
 		}
-		data := item.(*data)
 
 		if videoTrack != nil && data.trackID == videoTrackID {
 			if data.h264NALUs == nil {
@@ -417,7 +1089,7 @@ func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
 				IsKeyFrame:      idrPresent,
 				H264Type:        flvio.AVC_NALU,
 				Payload:         avcc,
-				DTS:             dts,
+				DTS:             dts + dtsOffset,
 				PTSDelta:        pts - dts,
 			})
 			if err != nil {
@@ -451,7 +1123,7 @@ func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
 					Channels:        flvio.SOUND_STEREO,
 					AACType:         flvio.AAC_RAW,
 					Payload:         au,
-					DTS: pts + time.Duration(i)*mpeg4audio.SamplesPerAccessUnit*
+					DTS: dtsOffset + pts + time.Duration(i)*mpeg4audio.SamplesPerAccessUnit*
 						time.Second/time.Duration(audioTrack.ClockRate()),
 				})
 				if err != nil {
@@ -462,9 +1134,75 @@ func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
 	}
 }
 
+// runReaderKeepalive makes the read loop send a ping every time
+// no data is sent to the reader for readerKeepalive.
+func (c *rtmpConn) runReaderKeepalive(ctx context.Context) {
+	period := time.Duration(c.readerKeepalive)
+
+	for {
+		wait := period - time.Since(time.Unix(0, atomic.LoadInt64(&c.lastDataPulled)))
+		if wait <= 0 {
+			c.pushReaderKeepalive()
+			atomic.StoreInt64(&c.lastDataPulled, time.Now().UnixNano())
+			wait = period
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *rtmpConn) pushReaderKeepalive() {
+	if c.readQueue != nil {
+		// when the queue is full, data is flowing and the ping is not needed.
+		select {
+		case c.readQueue <- rtmpConnKeepaliveData:
+		default:
+		}
+		return
+	}
+
+	c.ringBuffer.Push(rtmpConnKeepaliveData)
+}
+
+// pullData returns the next data to be sent to the reader.
+func (c *rtmpConn) pullData(ctx context.Context) (*data, bool) {
+	if c.readQueue == nil {
+		item, ok := c.ringBuffer.Pull()
+		if !ok {
+			return nil, false
+		}
+		return item.(*data), true
+	}
+
+	select {
+	case data := <-c.readQueue:
+		return data, true
+
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
 func (c *rtmpConn) runPublish(ctx context.Context, u *url.URL) error {
 	pathName, query, rawQuery := pathNameAndQuery(u)
 
+	if c.publishTokenValidator != nil {
+		err := c.publishTokenValidator(pathName, query.Get("token"))
+		if err != nil {
+			c.setState(rtmpConnStateAuth)
+
+			c.log(logger.Info, "publish token rejected: %s", err)
+
+			// wait some seconds to stop brute force attacks
+			<-time.After(rtmpConnPauseAfterAuthError)
+			return fmt.Errorf("publish token rejected")
+		}
+	}
+
 	res := c.pathManager.publisherAdd(pathPublisherAddReq{
 		author:   c,
 		pathName: pathName,
@@ -479,6 +1217,10 @@ func (c *rtmpConn) runPublish(ctx context.Context, u *url.URL) error {
 
 	if res.err != nil {
 		if terr, ok := res.err.(pathErrAuthCritical); ok {
+			c.setState(rtmpConnStateAuth)
+
+			c.log(logger.Info, "authentication failed: %s", terr.message)
+
 			// wait some seconds to stop brute force attacks
 			<-time.After(rtmpConnPauseAfterAuthError)
 			return errors.New(terr.message)
@@ -486,16 +1228,22 @@ func (c *rtmpConn) runPublish(ctx context.Context, u *url.URL) error {
 		return res.err
 	}
 
+	c.stateMutex.Lock()
 	c.path = res.path
+	c.stateMutex.Unlock()
 
 	defer func() {
 		c.path.publisherRemove(pathPublisherRemoveReq{author: c})
 	}()
 
-	c.stateMutex.Lock()
-	c.state = rtmpConnStatePublish
-	c.stateMutex.Unlock()
+	c.setState(rtmpConnStatePublish)
 
+	c.parent.connHandshakeDone(time.Since(c.created))
+
+	// deadlines set after the handshake may have expired while waiting for the path,
+	// refresh them so that they apply to single operations only.
+	c.nconn.SetReadDeadline(time.Now().Add(time.Duration(c.readTimeout)))
+	c.nconn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
 	videoTrack, audioTrack, err := c.conn.ReadTracks()
 	if err != nil {
 		return err
@@ -528,9 +1276,16 @@ func (c *rtmpConn) runPublish(ctx context.Context, u *url.URL) error {
 		c.path.Name(),
 		sourceTrackInfo(tracks))
 
+	c.parent.connPublish(c, c.path.Name())
+	defer c.parent.connUnpublish(c, c.path.Name())
+
 	// disable write deadline to allow outgoing acknowledges
 	c.nconn.SetWriteDeadline(time.Time{})
 
+	maxBitrate := uint64(c.path.Conf().RTMPMaxPublishBitrate)
+	bitrateMeter := &rtmpConnBitrateMeter{window: rtmpConnBitrateWindow}
+	var bitrateLastSample time.Time
+
 	for {
 		c.nconn.SetReadDeadline(time.Now().Add(time.Duration(c.readTimeout)))
 		msg, err := c.conn.ReadMessage()
@@ -538,6 +1293,28 @@ func (c *rtmpConn) runPublish(ctx context.Context, u *url.URL) error {
 			return err
 		}
 
+		if maxBitrate != 0 {
+			now := time.Now()
+			if now.Sub(bitrateLastSample) >= rtmpConnBitratePeriod {
+				bitrateLastSample = now
+
+				bitrate, ok := bitrateMeter.sample(now, c.bytesReceived())
+				if ok && bitrate > maxBitrate {
+					return rtmpConnErrBitrateExceeded{bitrate: bitrate, max: maxBitrate}
+				}
+			}
+		}
+
+		select {
+		case successor := <-c.chHandoff:
+			err := c.writeReconnectRequest(u, successor)
+			if err != nil {
+				return err
+			}
+
+		default:
+		}
+
 		switch tmsg := msg.(type) {
 		case *message.MsgVideo:
 			if tmsg.H264Type == flvio.AVC_SEQHDR {
@@ -613,6 +1390,20 @@ func (c *rtmpConn) runPublish(ctx context.Context, u *url.URL) error {
 	}
 }
 
+// writeReconnectRequest asks the client to publish the stream to another server.
+func (c *rtmpConn) writeReconnectRequest(u *url.URL, successor *url.URL) error {
+	nu := *u
+	nu.Scheme = successor.Scheme
+	nu.Host = successor.Host
+
+	c.log(logger.Info, "asking the publisher to reconnect to %s", nu.Host)
+
+	c.nconn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+	defer c.nconn.SetWriteDeadline(time.Time{})
+
+	return c.conn.WriteReconnectRequest(&nu)
+}
+
 func (c *rtmpConn) authenticate(
 	pathName string,
 	pathIPs []fmt.Stringer,
@@ -661,6 +1452,30 @@ func (c *rtmpConn) authenticate(
 
 // onReaderData implements reader.
 func (c *rtmpConn) onReaderData(data *data) {
+	if c.readQueue != nil {
+		select {
+		case c.readQueue <- data:
+			return
+		default:
+		}
+
+		// block the publisher until there's space in the queue,
+		// or until the reader is found to be stuck.
+		t := time.NewTimer(time.Duration(c.writeTimeout))
+		defer t.Stop()
+
+		select {
+		case c.readQueue <- data:
+		case <-c.readQueueDone:
+		case <-c.ctx.Done():
+		case <-t.C:
+			c.log(logger.Warn, "closing slow reader: unable to receive frames within %v",
+				time.Duration(c.writeTimeout))
+			c.closeWithReason(rtmpConnCloseReasonTimeout)
+		}
+		return
+	}
+
 	c.ringBuffer.Push(data)
 }
 
@@ -0,0 +1,101 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/notedit/rtmp/format/flv"
+	"github.com/notedit/rtmp/format/flv/flvio"
+
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/message"
+)
+
+const (
+	// distance between the last message of a loop and the first message of the next one.
+	rtmpFallbackLoopGap = 40 * time.Millisecond
+)
+
+// rtmpFallbackReader reads the H264 and AAC tags of a FLV file in a loop
+// and converts them into RTMP messages with increasing timestamps.
+type rtmpFallbackReader struct {
+	f       *os.File
+	dem     *flv.Demuxer
+	offset  time.Duration // added to the timestamps of the current loop
+	lastDTS time.Duration
+	found   bool // whether the current loop contains at least one message
+}
+
+func newRTMPFallbackReader(fpath string) (*rtmpFallbackReader, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rtmpFallbackReader{
+		f:   f,
+		dem: flv.NewDemuxer(f),
+	}, nil
+}
+
+func (r *rtmpFallbackReader) close() {
+	r.f.Close()
+}
+
+// next returns the next message and its DTS.
+func (r *rtmpFallbackReader) next() (message.Message, time.Duration, error) {
+	for {
+		tag, err := r.dem.ReadTag()
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				return nil, 0, err
+			}
+
+			if !r.found {
+				return nil, 0, fmt.Errorf("the file doesn't contain any H264 or AAC tag")
+			}
+
+			_, err := r.f.Seek(0, io.SeekStart)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			r.dem = flv.NewDemuxer(r.f)
+			r.offset = r.lastDTS + rtmpFallbackLoopGap
+			r.found = false
+			continue
+		}
+
+		dts := r.offset + time.Duration(tag.Time)*time.Millisecond
+
+		switch {
+		case tag.Type == flvio.TAG_VIDEO && tag.VideoFormat == flvio.VIDEO_H264:
+			r.found = true
+			r.lastDTS = dts
+			return &message.MsgVideo{
+				ChunkStreamID:   message.MsgVideoChunkStreamID,
+				MessageStreamID: 0x1000000,
+				IsKeyFrame:      tag.FrameType == flvio.FRAME_KEY,
+				H264Type:        tag.AVCPacketType,
+				Payload:         tag.Data,
+				DTS:             dts,
+				PTSDelta:        time.Duration(tag.CTime) * time.Millisecond,
+			}, dts, nil
+
+		case tag.Type == flvio.TAG_AUDIO && tag.SoundFormat == flvio.SOUND_AAC:
+			r.found = true
+			r.lastDTS = dts
+			return &message.MsgAudio{
+				ChunkStreamID:   message.MsgAudioChunkStreamID,
+				MessageStreamID: 0x1000000,
+				Rate:            tag.SoundRate,
+				Depth:           tag.SoundSize,
+				Channels:        tag.SoundType,
+				AACType:         tag.AACPacketType,
+				Payload:         tag.Data,
+				DTS:             dts,
+			}, dts, nil
+		}
+	}
+}
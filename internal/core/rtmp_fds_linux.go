@@ -0,0 +1,22 @@
+package core
+
+import (
+	"os"
+)
+
+// rtmpOpenFDs returns the number of file descriptors opened by the process.
+func rtmpOpenFDs() int {
+	f, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return 0
+	}
+
+	// exclude the descriptor used to read the directory
+	return len(names) - 1
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package core
+
+// rtmpOpenFDs returns the number of file descriptors opened by the process.
+// It is not available on this platform.
+func rtmpOpenFDs() int {
+	return 0
+}
@@ -0,0 +1,62 @@
+//go:build !windows
+// +build !windows
+
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func rtmpListen(network string, address string, reusePort bool, backlog int) (net.Listener, error) {
+	var lc net.ListenConfig
+
+	if reusePort {
+		lc.Control = func(network string, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+
+	ln, err := lc.Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if backlog != 0 {
+		// listen() can be called again on a listening socket in order to change the backlog.
+		rc, err := ln.(*net.TCPListener).SyscallConn()
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+
+		var serr error
+		err = rc.Control(func(fd uintptr) {
+			serr = syscall.Listen(int(fd), backlog)
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	return ln, nil
+}
+
+func rtmpListenAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
@@ -0,0 +1,24 @@
+//go:build windows
+// +build windows
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/windows"
+)
+
+func rtmpListen(network string, address string, reusePort bool, backlog int) (net.Listener, error) {
+	if reusePort || backlog != 0 {
+		return nil, fmt.Errorf("reusing ports and setting the backlog are not supported on Windows")
+	}
+
+	return net.Listen(network, address)
+}
+
+func rtmpListenAddrInUse(err error) bool {
+	return errors.Is(err, windows.WSAEADDRINUSE)
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	rtmpProxyHeaderTimeout = 5 * time.Second
+
+	// maximum length of a PROXY protocol v1 header, CRLF included.
+	rtmpProxyV1MaxLen = 107
+)
+
+var rtmpProxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// rtmpProxyConn is a connection whose remote address has been read from
+// a PROXY protocol header.
+type rtmpProxyConn struct {
+	net.Conn
+	br         *bufio.Reader
+	remoteAddr net.Addr
+}
+
+// newRTMPProxyConn reads a PROXY protocol v1 or v2 header from a connection.
+// When the header does not carry an address (LOCAL command, UNKNOWN protocol),
+// the address of the connection is kept.
+func newRTMPProxyConn(nconn net.Conn) (*rtmpProxyConn, error) {
+	c := &rtmpProxyConn{
+		Conn:       nconn,
+		br:         bufio.NewReader(nconn),
+		remoteAddr: nconn.RemoteAddr(),
+	}
+
+	nconn.SetReadDeadline(time.Now().Add(rtmpProxyHeaderTimeout))
+	defer nconn.SetReadDeadline(time.Time{})
+
+	sig, err := c.br.Peek(len(rtmpProxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.Equal(sig, rtmpProxyV2Signature):
+		err = c.readV2()
+
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		err = c.readV1()
+
+	default:
+		err = fmt.Errorf("PROXY header not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *rtmpProxyConn) readV1() error {
+	line, err := c.br.ReadSlice('\n')
+	if err != nil {
+		return err
+	}
+
+	if len(line) > rtmpProxyV1MaxLen || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return fmt.Errorf("invalid PROXY v1 header")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("invalid PROXY v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return fmt.Errorf("invalid source address: %s", fields[2])
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid source port: %s", fields[4])
+	}
+
+	c.remoteAddr = &net.TCPAddr{IP: ip, Port: int(port)}
+	return nil
+}
+
+func (c *rtmpProxyConn) readV2() error {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(c.br, header)
+	if err != nil {
+		return err
+	}
+
+	if (header[12] >> 4) != 2 {
+		return fmt.Errorf("unsupported PROXY version: %d", header[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	_, err = io.ReadFull(c.br, payload)
+	if err != nil {
+		return err
+	}
+
+	// LOCAL command: the connection has been opened by the proxy itself.
+	if (header[12] & 0x0F) == 0 {
+		return nil
+	}
+
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return fmt.Errorf("invalid PROXY v2 address length")
+		}
+		c.remoteAddr = &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:])),
+		}
+
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return fmt.Errorf("invalid PROXY v2 address length")
+		}
+		c.remoteAddr = &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:])),
+		}
+	}
+
+	return nil
+}
+
+// Read implements net.Conn.
+func (c *rtmpProxyConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+// RemoteAddr implements net.Conn.
+func (c *rtmpProxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
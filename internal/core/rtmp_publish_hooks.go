@@ -0,0 +1,142 @@
+package core
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aler9/rtsp-simple-server/internal/externalcmd"
+)
+
+// rtmpPublishHook is called when a path gains or loses its RTMP publisher.
+type rtmpPublishHook func(pathName string, connID string)
+
+type rtmpPublishHooksPending struct {
+	timer  *time.Timer
+	connID string
+}
+
+// rtmpPublishHooks calls onPublish when a path gains its RTMP publisher
+// and onUnpublish when the path loses it.
+// If debounce is not zero, onUnpublish is delayed, and a publisher that starts
+// publishing to the same path in the meanwhile doesn't trigger any hook.
+type rtmpPublishHooks struct {
+	debounce    time.Duration
+	onPublish   rtmpPublishHook // optional
+	onUnpublish rtmpPublishHook // optional
+
+	mutex   sync.Mutex
+	pending map[string]*rtmpPublishHooksPending
+}
+
+func newRTMPPublishHooks(
+	debounce time.Duration,
+	onPublish rtmpPublishHook,
+	onUnpublish rtmpPublishHook,
+) *rtmpPublishHooks {
+	return &rtmpPublishHooks{
+		debounce:    debounce,
+		onPublish:   onPublish,
+		onUnpublish: onUnpublish,
+		pending:     make(map[string]*rtmpPublishHooksPending),
+	}
+}
+
+// close runs the delayed hooks immediately.
+func (h *rtmpPublishHooks) close() {
+	h.mutex.Lock()
+	pending := h.pending
+	h.pending = make(map[string]*rtmpPublishHooksPending)
+	h.mutex.Unlock()
+
+	for pathName, p := range pending {
+		p.timer.Stop()
+		if h.onUnpublish != nil {
+			h.onUnpublish(pathName, p.connID)
+		}
+	}
+}
+
+// publish is called by rtmpConn.
+func (h *rtmpPublishHooks) publish(pathName string, connID string) {
+	h.mutex.Lock()
+	p, ok := h.pending[pathName]
+	if ok {
+		// the path lost its publisher recently, it didn't really go offline.
+		p.timer.Stop()
+		delete(h.pending, pathName)
+	}
+	h.mutex.Unlock()
+
+	if !ok && h.onPublish != nil {
+		h.onPublish(pathName, connID)
+	}
+}
+
+// unpublish is called by rtmpConn.
+func (h *rtmpPublishHooks) unpublish(pathName string, connID string) {
+	if h.debounce == 0 {
+		if h.onUnpublish != nil {
+			h.onUnpublish(pathName, connID)
+		}
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	p := &rtmpPublishHooksPending{connID: connID}
+	p.timer = time.AfterFunc(h.debounce, func() {
+		h.mutex.Lock()
+		// the hook was canceled by publish() or run by close().
+		if h.pending[pathName] != p {
+			h.mutex.Unlock()
+			return
+		}
+		delete(h.pending, pathName)
+		h.mutex.Unlock()
+
+		if h.onUnpublish != nil {
+			h.onUnpublish(pathName, connID)
+		}
+	})
+	h.pending[pathName] = p
+}
+
+// newRTMPPublishCmdHook returns a hook that runs an external command.
+// It returns nil when no command is provided.
+func newRTMPPublishCmdHook(
+	externalCmdPool *externalcmd.Pool,
+	cmdstr string,
+	rtspAddress string,
+	onExit func(pathName string, co int),
+) rtmpPublishHook {
+	if cmdstr == "" {
+		return nil
+	}
+
+	_, port, _ := net.SplitHostPort(rtspAddress)
+
+	return func(pathName string, connID string) {
+		exited := make(chan struct{})
+		cmd := externalcmd.NewCmd(
+			externalCmdPool,
+			cmdstr,
+			false,
+			externalcmd.Environment{
+				"RTSP_PATH":         pathName,
+				"RTSP_PORT":         port,
+				"RTSP_RTMP_CONN_ID": connID,
+			},
+			func(co int) {
+				onExit(pathName, co)
+				close(exited)
+			})
+
+		// the command is not restarted, release it as soon as it exits.
+		go func() {
+			<-exited
+			cmd.Close()
+		}()
+	}
+}
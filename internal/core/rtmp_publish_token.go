@@ -0,0 +1,41 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// rtmpPublishTokenValidator validates the token that a publisher provides
+// in the stream key. It returns an error when the publish must be denied.
+type rtmpPublishTokenValidator func(pathName string, token string) error
+
+// newRTMPPublishTokenValidator returns a validator that forwards the token to an HTTP service.
+// It returns nil when no URL is provided.
+func newRTMPPublishTokenValidator(ur string) rtmpPublishTokenValidator {
+	if ur == "" {
+		return nil
+	}
+
+	return func(pathName string, token string) error {
+		enc, _ := json.Marshal(struct {
+			Path  string `json:"path"`
+			Token string `json:"token"`
+		}{
+			Path:  pathName,
+			Token: token,
+		})
+		res, err := http.Post(ur, "application/json", bytes.NewReader(enc))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return fmt.Errorf("bad status code: %d", res.StatusCode)
+		}
+
+		return nil
+	}
+}
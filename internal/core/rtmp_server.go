@@ -4,10 +4,19 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"net/url"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/aler9/rtsp-simple-server/internal/conf"
@@ -15,128 +24,513 @@ import (
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
+const (
+	rtmpServerCheckPeriod     = 1 * time.Second
+	rtmpServerEventsQueueSize = 64
+
+	rtmpServerAcceptRetryMinDelay = 5 * time.Millisecond
+	rtmpServerAcceptRetryMaxDelay = 1 * time.Second
+
+	// maximum time a kick request can wait for the connection to close.
+	rtmpServerKickMaxWait = 1 * time.Minute
+)
+
+// upper bounds of the buckets of the handshake duration histogram, in seconds.
+var rtmpServerHandshakeBuckets = []float64{
+	0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+var (
+	// rtmpServerErrConnNotFound is returned by the API requests
+	// when no connection matches the given ID or address.
+	rtmpServerErrConnNotFound = errors.New("not found")
+
+	// rtmpServerErrInvalidAddr is returned by apiConnsKickByAddr when the address can't be parsed.
+	rtmpServerErrInvalidAddr = errors.New("invalid address")
+
+	// rtmpServerErrTerminated is returned by the API requests when the server is shutting down.
+	rtmpServerErrTerminated = errors.New("terminated")
+
+	// rtmpServerErrKickTimeout is returned by apiConnsKick when a kicked connection
+	// doesn't close within the requested time.
+	rtmpServerErrKickTimeout = errors.New("timed out while waiting for the connection to close")
+)
+
+// rtmpServerErrListen is returned by newRTMPServer when a listener can't be opened.
+type rtmpServerErrListen struct {
+	err error
+}
+
+// Error implements the error interface.
+func (e rtmpServerErrListen) Error() string {
+	return e.err.Error()
+}
+
 type rtmpServerAPIConnsListItem struct {
-	Created    time.Time `json:"created"`
-	RemoteAddr string    `json:"remoteAddr"`
-	State      string    `json:"state"`
+	Created        time.Time         `json:"created"`
+	ConnDuration   float64           `json:"connDuration"`
+	RemoteAddr     string            `json:"remoteAddr"`
+	State          string            `json:"state"`
+	BytesReceived  uint64            `json:"bytesReceived"`
+	BytesSent      uint64            `json:"bytesSent"`
+	Slow           bool              `json:"slow"`
+	ClientSoftware string            `json:"clientSoftware"`
+	Path           string            `json:"path"`
+	TLS            bool              `json:"tls"`
+	TLSVersion     string            `json:"tlsVersion,omitempty"`
+	TLSCipherSuite string            `json:"tlsCipherSuite,omitempty"`
+	Labels         map[string]string `json:"labels"`
+	ReadMode       string            `json:"readMode,omitempty"`
 }
 
 type rtmpServerAPIConnsListData struct {
-	Items map[string]rtmpServerAPIConnsListItem `json:"items"`
+	ItemCount int                                   `json:"itemCount"`
+	PageCount int                                   `json:"pageCount"`
+	Items     map[string]rtmpServerAPIConnsListItem `json:"items"`
+	Order     []string                              `json:"order"`
 }
 
 type rtmpServerAPIConnsListRes struct {
-	data *rtmpServerAPIConnsListData
-	err  error
+	data  *rtmpServerAPIConnsListData
+	conns []*rtmpConn // filled by run(), used to build data
+	err   error
 }
 
 type rtmpServerAPIConnsListReq struct {
-	res chan rtmpServerAPIConnsListRes
+	state        string // optional
+	page         int
+	itemsPerPage int // optional
+	res          chan rtmpServerAPIConnsListRes
+}
+
+type rtmpServerAPIConnsGetRes struct {
+	data *rtmpServerAPIConnsListItem
+	err  error
+}
+
+type rtmpServerAPIConnsGetReq struct {
+	id  string
+	res chan rtmpServerAPIConnsGetRes
 }
 
 type rtmpServerAPIConnsKickRes struct {
-	err error
+	done chan struct{}
+	err  error
 }
 
 type rtmpServerAPIConnsKickReq struct {
-	id  string
-	res chan rtmpServerAPIConnsKickRes
+	id   string
+	wait time.Duration // if not zero, wait until the connection is closed
+	res  chan rtmpServerAPIConnsKickRes
+}
+
+type rtmpServerAPIConnsKickByAddrData struct {
+	Count int `json:"count"`
+}
+
+type rtmpServerAPIConnsKickByAddrRes struct {
+	data *rtmpServerAPIConnsKickByAddrData
+	err  error
+}
+
+type rtmpServerAPIConnsKickByAddrReq struct {
+	addr string
+	res  chan rtmpServerAPIConnsKickByAddrRes
+}
+
+type rtmpServerAPIConnsKickIdleData struct {
+	Count int `json:"count"`
+}
+
+type rtmpServerAPIConnsKickIdleRes struct {
+	data *rtmpServerAPIConnsKickIdleData
+	err  error
+}
+
+type rtmpServerAPIConnsKickIdleReq struct {
+	res chan rtmpServerAPIConnsKickIdleRes
+}
+
+type rtmpServerAPIServerInfoData struct {
+	Addresses       []string            `json:"addresses"`
+	ReadTimeout     conf.StringDuration `json:"readTimeout"`
+	WriteTimeout    conf.StringDuration `json:"writeTimeout"`
+	ReadBufferCount int                 `json:"readBufferCount"`
+	TLS             bool                `json:"tls"`
+	Running         bool                `json:"running"`
+	LastAcceptError string              `json:"lastAcceptError"`
+	Started         time.Time           `json:"started"`
+	Uptime          float64             `json:"uptime"`
+	ConnsServed     uint64              `json:"connsServed"`
+	Conns           int                 `json:"conns"`
+	Routines        int64               `json:"routines"`
+	OpenFDs         int                 `json:"openFDs,omitempty"`
+}
+
+type rtmpServerAPIServerInfoRes struct {
+	data *rtmpServerAPIServerInfoData
+	err  error
+}
+
+type rtmpServerAPIServerInfoReq struct {
+	res chan rtmpServerAPIServerInfoRes
+}
+
+type rtmpServerAPIConnsEvent struct {
+	ID         string `json:"id"`
+	RemoteAddr string `json:"remoteAddr"`
+	State      string `json:"state"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+type rtmpServerAPIConnsSubscribeRes struct {
+	ch  chan rtmpServerAPIConnsEvent
+	err error
+}
+
+type rtmpServerAPIConnsSubscribeReq struct {
+	res chan rtmpServerAPIConnsSubscribeRes
+}
+
+// rtmpServerConfReloadReq contains the parameters that can be changed
+// without closing the server. They are applied to new connections only,
+// except connLogDisable, which applies to existing connections too.
+type rtmpServerConfReloadReq struct {
+	readTimeout         conf.StringDuration
+	writeTimeout        conf.StringDuration
+	handshakeTimeout    conf.StringDuration
+	writeChunkSize      int
+	connLogDisable      bool
+	waitPublisher       conf.StringDuration
+	readerKeepalive     conf.StringDuration
+	runOnConnect        string
+	runOnConnectRestart bool
+	runOnDisconnect     string
+}
+
+func newRTMPServerConfReloadReq(c *conf.Conf) rtmpServerConfReloadReq {
+	return rtmpServerConfReloadReq{
+		readTimeout:         c.ReadTimeout,
+		writeTimeout:        c.WriteTimeout,
+		handshakeTimeout:    c.RTMPHandshakeTimeout,
+		writeChunkSize:      c.RTMPWriteChunkSize,
+		connLogDisable:      c.RTMPConnLogDisable,
+		waitPublisher:       c.RTMPReadWaitPublisher,
+		readerKeepalive:     c.RTMPReaderKeepalive,
+		runOnConnect:        c.RunOnConnect,
+		runOnConnectRestart: c.RunOnConnectRestart,
+		runOnDisconnect:     c.RunOnDisconnect,
+	}
+}
+
+type rtmpServerConnsStats struct {
+	accepted      uint64
+	kicked        uint64
+	refusedLimit  uint64
+	refusedDenied uint64
+	refusedRate   uint64
+}
+
+// rtmpServerPathStats contains the bytes transferred by connections attached to a path.
+type rtmpServerPathStats struct {
+	conns         int
+	bytesReceived uint64
+	bytesSent     uint64
+}
+
+type rtmpServerPathsStatsRes struct {
+	closed map[string]rtmpServerPathStats // bytes of connections that are closed
+	conns  map[*rtmpConn]string           // connections that are open
+}
+
+// rtmpServerWaitGroup is a sync.WaitGroup that counts the routines it's waiting for,
+// in order to detect leaks.
+type rtmpServerWaitGroup struct {
+	count int64 // first for 64-bit alignment
+	sync.WaitGroup
+}
+
+// Add implements sync.WaitGroup.
+func (wg *rtmpServerWaitGroup) Add(delta int) {
+	atomic.AddInt64(&wg.count, int64(delta))
+	wg.WaitGroup.Add(delta)
+}
+
+// Done implements sync.WaitGroup.
+func (wg *rtmpServerWaitGroup) Done() {
+	atomic.AddInt64(&wg.count, -1)
+	wg.WaitGroup.Done()
+}
+
+func (wg *rtmpServerWaitGroup) routines() int64 {
+	return atomic.LoadInt64(&wg.count)
+}
+
+type rtmpServerCloseGracefulReq struct {
+	timeout    time.Duration
+	handoffURL string // optional
 }
 
 type rtmpServerParent interface {
-	Log(logger.Level, string, ...interface{})
+	LogComponent(logger.Level, string, string, ...interface{})
 }
 
 type rtmpServer struct {
+	connsAccepted      uint64 // first for alignment
+	connsKicked        uint64
+	connsRefusedLimit  uint64
+	connsRefusedDenied uint64
+	connsRefusedRate   uint64
+	healthy            int32
+	connLogDisable     int32
+
 	externalAuthenticationURL string
+	publishTokenValidator     rtmpPublishTokenValidator
 	readTimeout               conf.StringDuration
 	writeTimeout              conf.StringDuration
+	handshakeTimeout          conf.StringDuration
+	writeChunkSize            int
+	waitPublisher             conf.StringDuration
+	readerKeepalive           conf.StringDuration
 	readBufferCount           int
+	listenRetries             int
+	listenRetryInterval       conf.StringDuration
+	tcpReadBufferSize         int
+	tcpWriteBufferSize        int
+	tcpNoDelayDisable         bool
+	tcpLinger                 conf.StringDuration
+	proxyProtocol             bool
+	maxConns                  int
+	connRateLimit             int
+	connRateWindow            conf.StringDuration
+	allowedNets               conf.IPsOrCIDRs
+	deniedNets                conf.IPsOrCIDRs
+	allowedPaths              conf.PathPatterns
+	connIDGenerator           func() (string, error)
+	idleTimeout               conf.StringDuration
+	slowWriteThreshold        conf.StringDuration
+	slowReaderKickAfter       conf.StringDuration
 	isTLS                     bool
+	serverCert                string
+	serverKey                 string
 	rtspAddress               string
 	runOnConnect              string
 	runOnConnectRestart       bool
+	runOnDisconnect           string
+	publishHooks              *rtmpPublishHooks
 	externalCmdPool           *externalcmd.Pool
 	metrics                   *metrics
 	pathManager               *pathManager
 	parent                    rtmpServerParent
 
-	ctx       context.Context
-	ctxCancel func()
-	wg        sync.WaitGroup
-	ln        net.Listener
-	conns     map[*rtmpConn]struct{}
+	ctx         context.Context
+	ctxCancel   func()
+	started     time.Time
+	wg          rtmpServerWaitGroup
+	lns         []net.Listener
+	conns       map[*rtmpConn]struct{}
+	connsByID   map[string]*rtmpConn
+	connRates   map[string][]time.Time
+	subscribers map[chan rtmpServerAPIConnsEvent]struct{}
+	slowSince   map[*rtmpConn]time.Time
+
+	handshakeHistogram *metricsHistogram
+	pathStats          map[string]*rtmpServerPathStats
+	connPaths          map[*rtmpConn]string
+
+	certMutex        sync.Mutex
+	cert             *tls.Certificate
+	certModTime      time.Time
+	keyModTime       time.Time
+	certReloadFailed bool // accessed by run() only
+
+	acceptErrMutex sync.Mutex
+	acceptErr      error
 
 	// in
-	chConnClose    chan *rtmpConn
-	chAPIConnsList chan rtmpServerAPIConnsListReq
-	chAPIConnsKick chan rtmpServerAPIConnsKickReq
+	chConfReload          chan rtmpServerConfReloadReq
+	chCloseGraceful       chan rtmpServerCloseGracefulReq
+	chConnStateChange     chan *rtmpConn
+	chConnClose           chan *rtmpConn
+	chPathsStats          chan chan rtmpServerPathsStatsRes
+	chAPIConnsList        chan rtmpServerAPIConnsListReq
+	chAPIConnsGet         chan rtmpServerAPIConnsGetReq
+	chAPIConnsKick        chan rtmpServerAPIConnsKickReq
+	chAPIConnsKickByAddr  chan rtmpServerAPIConnsKickByAddrReq
+	chAPIConnsKickIdle    chan rtmpServerAPIConnsKickIdleReq
+	chAPIConnsSubscribe   chan rtmpServerAPIConnsSubscribeReq
+	chAPIConnsUnsubscribe chan chan rtmpServerAPIConnsEvent
+	chAPIServerInfo       chan rtmpServerAPIServerInfoReq
 }
 
 func newRTMPServer(
 	parentCtx context.Context,
 	externalAuthenticationURL string,
-	address string,
+	publishTokenValidator rtmpPublishTokenValidator,
+	addresses []string,
+	network string,
+	reusePort bool,
+	listenBacklog int,
+	listenRetries int,
+	listenRetryInterval conf.StringDuration,
+	tcpReadBufferSize int,
+	tcpWriteBufferSize int,
+	tcpNoDelayDisable bool,
+	tcpLinger conf.StringDuration,
+	proxyProtocol bool,
 	readTimeout conf.StringDuration,
 	writeTimeout conf.StringDuration,
+	handshakeTimeout conf.StringDuration,
+	writeChunkSize int,
+	connLogDisable bool,
+	waitPublisher conf.StringDuration,
+	readerKeepalive conf.StringDuration,
 	readBufferCount int,
+	maxConns int,
+	connRateLimit int,
+	connRateWindow conf.StringDuration,
+	allowedNets conf.IPsOrCIDRs,
+	deniedNets conf.IPsOrCIDRs,
+	allowedPaths conf.PathPatterns,
+	connIDFormat conf.ConnIDFormat,
+	connIDPrefix string,
+	idleTimeout conf.StringDuration,
+	slowWriteThreshold conf.StringDuration,
+	slowReaderKickAfter conf.StringDuration,
 	isTLS bool,
 	serverCert string,
 	serverKey string,
 	rtspAddress string,
 	runOnConnect string,
 	runOnConnectRestart bool,
+	runOnDisconnect string,
+	runOnPublish string,
+	runOnUnpublish string,
+	publishHookDebounce conf.StringDuration,
 	externalCmdPool *externalcmd.Pool,
 	metrics *metrics,
 	pathManager *pathManager,
 	parent rtmpServerParent,
 ) (*rtmpServer, error) {
-	ln, err := func() (net.Listener, error) {
-		if !isTLS {
-			return net.Listen("tcp", address)
-		}
-
-		cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
-		if err != nil {
-			return nil, err
-		}
-
-		return tls.Listen("tcp", address, &tls.Config{Certificates: []tls.Certificate{cert}})
-	}()
-	if err != nil {
-		return nil, err
-	}
-
 	ctx, ctxCancel := context.WithCancel(parentCtx)
 
 	s := &rtmpServer{
 		externalAuthenticationURL: externalAuthenticationURL,
+		publishTokenValidator:     publishTokenValidator,
 		readTimeout:               readTimeout,
 		writeTimeout:              writeTimeout,
+		handshakeTimeout:          handshakeTimeout,
+		writeChunkSize:            writeChunkSize,
+		waitPublisher:             waitPublisher,
+		readerKeepalive:           readerKeepalive,
 		readBufferCount:           readBufferCount,
+		tcpReadBufferSize:         tcpReadBufferSize,
+		listenRetries:             listenRetries,
+		listenRetryInterval:       listenRetryInterval,
+		tcpWriteBufferSize:        tcpWriteBufferSize,
+		tcpNoDelayDisable:         tcpNoDelayDisable,
+		tcpLinger:                 tcpLinger,
+		proxyProtocol:             proxyProtocol,
+		maxConns:                  maxConns,
+		connRateLimit:             connRateLimit,
+		connRateWindow:            connRateWindow,
+		allowedNets:               allowedNets,
+		deniedNets:                deniedNets,
+		allowedPaths:              allowedPaths,
+		connIDGenerator:           rtmpServerConnIDGenerator(connIDFormat, connIDPrefix),
+		idleTimeout:               idleTimeout,
+		slowWriteThreshold:        slowWriteThreshold,
+		slowReaderKickAfter:       slowReaderKickAfter,
 		rtspAddress:               rtspAddress,
 		runOnConnect:              runOnConnect,
 		runOnConnectRestart:       runOnConnectRestart,
+		runOnDisconnect:           runOnDisconnect,
 		isTLS:                     isTLS,
+		serverCert:                serverCert,
+		serverKey:                 serverKey,
 		externalCmdPool:           externalCmdPool,
 		metrics:                   metrics,
 		pathManager:               pathManager,
 		parent:                    parent,
 		ctx:                       ctx,
 		ctxCancel:                 ctxCancel,
-		ln:                        ln,
+		started:                   time.Now(),
 		conns:                     make(map[*rtmpConn]struct{}),
+		connsByID:                 make(map[string]*rtmpConn),
+		connRates:                 make(map[string][]time.Time),
+		subscribers:               make(map[chan rtmpServerAPIConnsEvent]struct{}),
+		slowSince:                 make(map[*rtmpConn]time.Time),
+		handshakeHistogram:        newMetricsHistogram(rtmpServerHandshakeBuckets),
+		pathStats:                 make(map[string]*rtmpServerPathStats),
+		connPaths:                 make(map[*rtmpConn]string),
+		chConfReload:              make(chan rtmpServerConfReloadReq),
+		chCloseGraceful:           make(chan rtmpServerCloseGracefulReq),
+		chConnStateChange:         make(chan *rtmpConn),
 		chConnClose:               make(chan *rtmpConn),
+		chPathsStats:              make(chan chan rtmpServerPathsStatsRes),
 		chAPIConnsList:            make(chan rtmpServerAPIConnsListReq),
+		chAPIConnsGet:             make(chan rtmpServerAPIConnsGetReq),
 		chAPIConnsKick:            make(chan rtmpServerAPIConnsKickReq),
+		chAPIConnsKickByAddr:      make(chan rtmpServerAPIConnsKickByAddrReq),
+		chAPIConnsKickIdle:        make(chan rtmpServerAPIConnsKickIdleReq),
+		chAPIConnsSubscribe:       make(chan rtmpServerAPIConnsSubscribeReq),
+		chAPIConnsUnsubscribe:     make(chan chan rtmpServerAPIConnsEvent),
+		chAPIServerInfo:           make(chan rtmpServerAPIServerInfoReq),
+	}
+
+	s.setConnLogDisable(connLogDisable)
+
+	s.publishHooks = newRTMPPublishHooks(
+		time.Duration(publishHookDebounce),
+		newRTMPPublishCmdHook(externalCmdPool, runOnPublish, rtspAddress, func(pathName string, co int) {
+			s.log(logger.Info, "rtmpRunOnPublish command for path '%s' exited with code %d", pathName, co)
+		}),
+		newRTMPPublishCmdHook(externalCmdPool, runOnUnpublish, rtspAddress, func(pathName string, co int) {
+			s.log(logger.Info, "rtmpRunOnUnpublish command for path '%s' exited with code %d", pathName, co)
+		}))
+
+	if isTLS {
+		if serverCert == "" || serverKey == "" {
+			ctxCancel()
+			return nil, fmt.Errorf("both the server certificate and the server key must be provided")
+		}
+
+		err := s.loadCertificate()
+		if err != nil {
+			ctxCancel()
+			return nil, err
+		}
 	}
 
-	s.log(logger.Info, "listener opened on %s", address)
+	for _, address := range addresses {
+		ln, err := s.listen(network, address, reusePort, listenBacklog)
+		if err != nil {
+			for _, ln := range s.lns {
+				ln.Close()
+			}
+			ctxCancel()
+			return nil, rtmpServerErrListen{err}
+		}
+
+		s.lns = append(s.lns, ln)
+
+		if s.isTLS {
+			s.log(logger.Info, "listener opened on %s (%s, TLS)", address, network)
+		} else {
+			s.log(logger.Info, "listener opened on %s (%s)", address, network)
+		}
+	}
 
 	if s.metrics != nil {
-		s.metrics.rtmpServerSet(s)
+		if s.isTLS {
+			s.metrics.rtmpsServerSet(s)
+		} else {
+			s.metrics.rtmpServerSet(s)
+		}
 	}
 
+	atomic.StoreInt32(&s.healthy, 1)
+
 	s.wg.Add(1)
 	go s.run()
 
@@ -150,189 +544,1217 @@ func (s *rtmpServer) log(level logger.Level, format string, args ...interface{})
 		}
 		return "RTMP"
 	}()
-	s.parent.Log(level, "[%s] "+format, append([]interface{}{label}, args...)...)
+	s.parent.LogComponent(level, label, format, args...)
 }
 
 func (s *rtmpServer) close() {
 	s.log(logger.Info, "listener is closing")
 	s.ctxCancel()
 	s.wg.Wait()
+	s.publishHooks.close()
+}
+
+// closeGraceful stops accepting connections and waits for the existing ones
+// to terminate. Connections still open when the timeout elapses are closed.
+// If handoffURL is set, publishers are asked to reconnect to it.
+func (s *rtmpServer) closeGraceful(timeout time.Duration, handoffURL string) {
+	s.log(logger.Info, "listener is closing gracefully")
+	select {
+	case s.chCloseGraceful <- rtmpServerCloseGracefulReq{timeout: timeout, handoffURL: handoffURL}:
+	case <-s.ctx.Done():
+	}
+	s.wg.Wait()
+	s.publishHooks.close()
 }
 
 func (s *rtmpServer) run() {
 	defer s.wg.Done()
 
-	s.wg.Add(1)
 	connNew := make(chan net.Conn)
 	acceptErr := make(chan error)
-	go func() {
-		defer s.wg.Done()
-		err := func() error {
-			for {
-				conn, err := s.ln.Accept()
-				if err != nil {
-					return err
-				}
 
-				select {
-				case connNew <- conn:
-				case <-s.ctx.Done():
-					conn.Close()
+	for _, ln := range s.lns {
+		s.wg.Add(1)
+		go func(ln net.Listener) {
+			defer s.wg.Done()
+			err := func() error {
+				var retryDelay time.Duration
+
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						if !rtmpServerAcceptErrTemporary(err) {
+							return err
+						}
+
+						// wait for the condition to clear, for instance for file descriptors
+						// to be released, instead of stopping the server.
+						if retryDelay == 0 {
+							retryDelay = rtmpServerAcceptRetryMinDelay
+						} else {
+							retryDelay *= 2
+						}
+						if retryDelay > rtmpServerAcceptRetryMaxDelay {
+							retryDelay = rtmpServerAcceptRetryMaxDelay
+						}
+
+						s.log(logger.Warn, "accept error, retrying in %v: %s", retryDelay, err)
+
+						select {
+						case <-time.After(retryDelay):
+							continue
+						case <-s.ctx.Done():
+							return err
+						}
+					}
+
+					retryDelay = 0
+
+					// the PROXY header is read in a dedicated routine
+					// in order not to block other connections.
+					if s.proxyProtocol {
+						s.wg.Add(1)
+						go s.acceptProxyConn(conn, connNew)
+						continue
+					}
+
+					s.acceptConn(conn, connNew)
 				}
+			}()
+
+			select {
+			case acceptErr <- err:
+			case <-s.ctx.Done():
 			}
-		}()
+		}(ln)
+	}
 
-		select {
-		case acceptErr <- err:
-		case <-s.ctx.Done():
-		}
-	}()
+	draining := false
+	drainTimer := newEmptyTimer()
+	defer func() { drainTimer.Stop() }()
+
+	var connRatesCleanup <-chan time.Time
+	if s.connRateLimit != 0 {
+		t := time.NewTicker(time.Duration(s.connRateWindow))
+		defer t.Stop()
+		connRatesCleanup = t.C
+	}
+
+	var certCheck <-chan time.Time
+	if s.isTLS {
+		t := time.NewTicker(rtmpServerCheckPeriod)
+		defer t.Stop()
+		certCheck = t.C
+	}
+
+	var connsCheck <-chan time.Time
+	if s.idleTimeout != 0 || (s.slowWriteThreshold != 0 && s.slowReaderKickAfter != 0) {
+		t := time.NewTicker(rtmpServerCheckPeriod)
+		defer t.Stop()
+		connsCheck = t.C
+	}
 
 outer:
 	for {
 		select {
 		case err := <-acceptErr:
+			if draining {
+				continue
+			}
 			s.log(logger.Error, "%s", err)
+			atomic.StoreInt32(&s.healthy, 0)
+			s.acceptErrMutex.Lock()
+			s.acceptErr = err
+			s.acceptErrMutex.Unlock()
 			break outer
 
 		case nconn := <-connNew:
-			id, _ := s.newConnID()
+			if draining {
+				nconn.Close()
+				continue
+			}
+
+			ip := nconn.RemoteAddr().(*net.TCPAddr).IP
+
+			if !s.ipAllowed(ip) {
+				s.log(logger.Info, "connection refused: %s is not allowed", ip)
+				atomic.AddUint64(&s.connsRefusedDenied, 1)
+				nconn.Close()
+				continue
+			}
+
+			if s.connRateExceeded(ip.String(), time.Now()) {
+				s.log(logger.Warn, "connection refused: too many connections from %s", ip)
+				atomic.AddUint64(&s.connsRefusedRate, 1)
+				nconn.Close()
+				continue
+			}
+
+			if s.maxConns != 0 && len(s.conns) >= s.maxConns {
+				s.log(logger.Warn, "connection refused: limit reached (%d)", s.maxConns)
+				atomic.AddUint64(&s.connsRefusedLimit, 1)
+				nconn.Close()
+				continue
+			}
+
+			id, err := s.newConnID()
+			if err != nil {
+				s.log(logger.Error, "connection refused: unable to generate an ID: %s", err)
+				nconn.Close()
+				continue
+			}
+
+			atomic.AddUint64(&s.connsAccepted, 1)
+
+			s.setTCPOptions(nconn)
 
 			c := newRTMPConn(
 				s.ctx,
 				s.isTLS,
 				id,
 				s.externalAuthenticationURL,
+				s.publishTokenValidator,
+				s.allowedPaths,
 				s.rtspAddress,
 				s.readTimeout,
 				s.writeTimeout,
+				s.handshakeTimeout,
+				s.writeChunkSize,
+				s.waitPublisher,
+				s.readerKeepalive,
 				s.readBufferCount,
 				s.runOnConnect,
 				s.runOnConnectRestart,
+				s.runOnDisconnect,
 				&s.wg,
 				nconn,
 				s.externalCmdPool,
 				s.pathManager,
 				s)
 			s.conns[c] = struct{}{}
+			s.connsByID[id] = c
+			s.publishConnEvent(c, "idle")
+
+		case c := <-s.chConnStateChange:
+			if _, ok := s.conns[c]; !ok {
+				continue
+			}
+			s.publishConnEvent(c, rtmpServerAPIConnState(c.safeState()))
+			s.pathStatsAdd(c)
 
 		case c := <-s.chConnClose:
+			s.publishConnEvent(c, "closed")
+			s.pathStatsRemove(c)
+
 			if _, ok := s.conns[c]; !ok {
 				continue
 			}
-			delete(s.conns, c)
+			s.deleteConn(c)
+
+			if draining && len(s.conns) == 0 {
+				break outer
+			}
+
+		case req := <-s.chPathsStats:
+			res := rtmpServerPathsStatsRes{
+				closed: make(map[string]rtmpServerPathStats, len(s.pathStats)),
+				conns:  make(map[*rtmpConn]string, len(s.connPaths)),
+			}
+			for path, st := range s.pathStats {
+				res.closed[path] = *st
+			}
+			for c, path := range s.connPaths {
+				res.conns[c] = path
+			}
+			req <- res
 
 		case req := <-s.chAPIConnsList:
-			data := &rtmpServerAPIConnsListData{
-				Items: make(map[string]rtmpServerAPIConnsListItem),
+			// the response is built by the caller, in order not to block the loop.
+			req.res <- rtmpServerAPIConnsListRes{conns: s.connsSnapshot()}
+
+		case req := <-s.chAPIConnsGet:
+			c, ok := s.connsByID[req.id]
+			if !ok {
+				req.res <- rtmpServerAPIConnsGetRes{err: fmt.Errorf("connection '%s' %w", req.id, rtmpServerErrConnNotFound)}
+				continue
 			}
 
+			item := s.apiConnsListItem(c, time.Now())
+			req.res <- rtmpServerAPIConnsGetRes{data: &item}
+
+		case req := <-s.chAPIConnsKick:
+			c, ok := s.connsByID[req.id]
+			if !ok {
+				req.res <- rtmpServerAPIConnsKickRes{err: fmt.Errorf("connection '%s' %w", req.id, rtmpServerErrConnNotFound)}
+				continue
+			}
+
+			s.deleteConn(c)
+			c.closeWithReason(rtmpConnCloseReasonKicked)
+			atomic.AddUint64(&s.connsKicked, 1)
+			req.res <- rtmpServerAPIConnsKickRes{done: c.done}
+
+		case req := <-s.chAPIConnsKickByAddr:
+			match, err := rtmpServerAddrMatcher(req.addr)
+			if err != nil {
+				req.res <- rtmpServerAPIConnsKickByAddrRes{err: err}
+				continue
+			}
+
+			count := 0
 			for c := range s.conns {
-				data.Items[c.id] = rtmpServerAPIConnsListItem{
-					Created:    c.created,
-					RemoteAddr: c.remoteAddr().String(),
-					State: func() string {
-						switch c.safeState() {
-						case rtmpConnStateRead:
-							return "read"
-
-						case rtmpConnStatePublish:
-							return "publish"
-						}
-						return "idle"
-					}(),
+				if match(c.remoteAddr()) {
+					s.deleteConn(c)
+					c.closeWithReason(rtmpConnCloseReasonKicked)
+					atomic.AddUint64(&s.connsKicked, 1)
+					count++
 				}
 			}
 
-			req.res <- rtmpServerAPIConnsListRes{data: data}
+			if count == 0 {
+				req.res <- rtmpServerAPIConnsKickByAddrRes{err: fmt.Errorf("connections from '%s' %w", req.addr, rtmpServerErrConnNotFound)}
+			} else {
+				req.res <- rtmpServerAPIConnsKickByAddrRes{data: &rtmpServerAPIConnsKickByAddrData{Count: count}}
+			}
 
-		case req := <-s.chAPIConnsKick:
-			res := func() bool {
-				for c := range s.conns {
-					if c.id == req.id {
-						delete(s.conns, c)
-						c.close()
-						return true
-					}
+		case req := <-s.chAPIConnsKickIdle:
+			count := 0
+			for c := range s.conns {
+				if c.safeState() == rtmpConnStateIdle {
+					s.deleteConn(c)
+					c.closeWithReason(rtmpConnCloseReasonKicked)
+					atomic.AddUint64(&s.connsKicked, 1)
+					count++
 				}
-				return false
-			}()
-			if res {
-				req.res <- rtmpServerAPIConnsKickRes{}
-			} else {
-				req.res <- rtmpServerAPIConnsKickRes{fmt.Errorf("not found")}
 			}
 
+			req.res <- rtmpServerAPIConnsKickIdleRes{data: &rtmpServerAPIConnsKickIdleData{Count: count}}
+
+		case req := <-s.chConfReload:
+			s.readTimeout = req.readTimeout
+			s.writeTimeout = req.writeTimeout
+			s.handshakeTimeout = req.handshakeTimeout
+			s.writeChunkSize = req.writeChunkSize
+			s.setConnLogDisable(req.connLogDisable)
+			s.waitPublisher = req.waitPublisher
+			s.readerKeepalive = req.readerKeepalive
+			s.runOnConnect = req.runOnConnect
+			s.runOnConnectRestart = req.runOnConnectRestart
+			s.runOnDisconnect = req.runOnDisconnect
+
+		case req := <-s.chCloseGraceful:
+			draining = true
+			atomic.StoreInt32(&s.healthy, 0)
+			s.closeListeners()
+
+			if len(s.conns) == 0 {
+				break outer
+			}
+
+			if req.handoffURL != "" {
+				s.handoffPublishers(req.handoffURL)
+			}
+
+			s.log(logger.Info, "waiting for %d connection(s) to terminate", len(s.conns))
+			drainTimer.Stop()
+			drainTimer = time.NewTimer(req.timeout)
+
+		case <-certCheck:
+			s.checkCertificate()
+
+		case now := <-connRatesCleanup:
+			for ip, times := range s.connRates {
+				if now.Sub(times[len(times)-1]) >= time.Duration(s.connRateWindow) {
+					delete(s.connRates, ip)
+				}
+			}
+
+		case now := <-connsCheck:
+			s.checkConns(now)
+
+		case req := <-s.chAPIConnsSubscribe:
+			ch := make(chan rtmpServerAPIConnsEvent, rtmpServerEventsQueueSize)
+			s.subscribers[ch] = struct{}{}
+			req.res <- rtmpServerAPIConnsSubscribeRes{ch: ch}
+
+		case ch := <-s.chAPIConnsUnsubscribe:
+			if _, ok := s.subscribers[ch]; ok {
+				delete(s.subscribers, ch)
+				close(ch)
+			}
+
+		case req := <-s.chAPIServerInfo:
+			req.res <- rtmpServerAPIServerInfoRes{data: &rtmpServerAPIServerInfoData{
+				Addresses:       s.listenAddresses(),
+				ReadTimeout:     s.readTimeout,
+				WriteTimeout:    s.writeTimeout,
+				ReadBufferCount: s.readBufferCount,
+				TLS:             s.isTLS,
+				Running:         !draining,
+				Started:         s.started,
+				Uptime:          time.Since(s.started).Seconds(),
+				ConnsServed:     atomic.LoadUint64(&s.connsAccepted),
+				Conns:           len(s.conns),
+				Routines:        s.wg.routines(),
+				OpenFDs:         rtmpOpenFDs(),
+			}}
+
+		case <-drainTimer.C:
+			s.log(logger.Info, "closing %d remaining connection(s)", len(s.conns))
+			break outer
+
 		case <-s.ctx.Done():
 			break outer
 		}
 	}
 
+	atomic.StoreInt32(&s.healthy, 0)
+
 	s.ctxCancel()
 
-	s.ln.Close()
+	s.closeListeners()
+
+	for ch := range s.subscribers {
+		close(ch)
+	}
 
 	if s.metrics != nil {
-		s.metrics.rtmpServerSet(s)
+		if s.isTLS {
+			s.metrics.rtmpsServerSet(s)
+		} else {
+			s.metrics.rtmpServerSet(s)
+		}
 	}
 }
 
-func (s *rtmpServer) newConnID() (string, error) {
-	for {
-		b := make([]byte, 4)
-		_, err := rand.Read(b)
-		if err != nil {
-			return "", err
-		}
+// connsSnapshot returns the current connections.
+func (s *rtmpServer) connsSnapshot() []*rtmpConn {
+	conns := make([]*rtmpConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
 
-		u := uint32(b[3])<<24 | uint32(b[2])<<16 | uint32(b[1])<<8 | uint32(b[0])
-		u %= 899999999
-		u += 100000000
+// apiConnsListData builds the response of a list request from a snapshot of connections.
+func (s *rtmpServer) apiConnsListData(
+	conns []*rtmpConn,
+	req rtmpServerAPIConnsListReq,
+) *rtmpServerAPIConnsListData {
+	data := &rtmpServerAPIConnsListData{
+		Items: make(map[string]rtmpServerAPIConnsListItem),
+	}
 
-		id := strconv.FormatUint(uint64(u), 10)
+	now := time.Now()
 
-		alreadyPresent := func() bool {
-			for c := range s.conns {
-				if c.id == id {
-					return true
-				}
-			}
-			return false
-		}()
-		if !alreadyPresent {
-			return id, nil
+	for _, c := range conns {
+		state := rtmpServerAPIConnState(c.safeState())
+
+		if req.state != "" && state != req.state {
+			continue
 		}
+
+		data.Items[c.id] = s.apiConnsListItem(c, now)
 	}
+
+	data.ItemCount = len(data.Items)
+	data.PageCount = rtmpServerAPIConnsListPaginate(data.Items, req.page, req.itemsPerPage)
+	data.Order = rtmpServerAPIConnsListOrder(data.Items)
+
+	return data
 }
 
-// connClose is called by rtmpConn.
-func (s *rtmpServer) connClose(c *rtmpConn) {
-	select {
-	case s.chConnClose <- c:
-	case <-s.ctx.Done():
+func (s *rtmpServer) apiConnsListItem(c *rtmpConn, now time.Time) rtmpServerAPIConnsListItem {
+	tlsVersion, tlsCipherSuite := c.safeTLSState()
+
+	return rtmpServerAPIConnsListItem{
+		Created:        c.created,
+		ConnDuration:   now.Sub(c.created).Seconds(),
+		RemoteAddr:     c.remoteAddr().String(),
+		State:          rtmpServerAPIConnState(c.safeState()),
+		BytesReceived:  c.bytesReceived(),
+		BytesSent:      c.bytesSent(),
+		Slow:           s.connIsSlow(c),
+		ClientSoftware: c.safeClientSoftware(),
+		Path:           c.safePathName(),
+		TLS:            c.isEncrypted(),
+		TLSVersion:     tlsVersion,
+		TLSCipherSuite: tlsCipherSuite,
+		Labels:         c.safeLabels(),
+		ReadMode:       c.safeReadMode(),
 	}
 }
 
-// apiConnsList is called by api.
-func (s *rtmpServer) apiConnsList(req rtmpServerAPIConnsListReq) rtmpServerAPIConnsListRes {
-	req.res = make(chan rtmpServerAPIConnsListRes)
-	select {
-	case s.chAPIConnsList <- req:
-		return <-req.res
+// handoffPublishers asks publishers to reconnect to another server.
+func (s *rtmpServer) handoffPublishers(handoffURL string) {
+	u, err := url.Parse(handoffURL)
+	if err != nil {
+		s.log(logger.Warn, "invalid handoff URL: %s", err)
+		return
+	}
 
-	case <-s.ctx.Done():
-		return rtmpServerAPIConnsListRes{err: fmt.Errorf("terminated")}
+	count := 0
+	for c := range s.conns {
+		if c.safeState() == rtmpConnStatePublish {
+			c.handoff(u)
+			count++
+		}
+	}
+
+	if count != 0 {
+		s.log(logger.Info, "asking %d publisher(s) to reconnect to %s", count, u.Host)
 	}
 }
 
-// apiConnsKick is called by api.
-func (s *rtmpServer) apiConnsKick(req rtmpServerAPIConnsKickReq) rtmpServerAPIConnsKickRes {
-	req.res = make(chan rtmpServerAPIConnsKickRes)
-	select {
-	case s.chAPIConnsKick <- req:
+// listen opens a listener. When the address is in use, for instance by a previous
+// instance that is still terminating, it retries with an exponential backoff.
+func (s *rtmpServer) listen(network string, address string, reusePort bool, backlog int) (net.Listener, error) {
+	interval := time.Duration(s.listenRetryInterval)
+
+	for i := 0; ; i++ {
+		ln, err := rtmpListen(network, address, reusePort, backlog)
+		if err == nil || i >= s.listenRetries || !rtmpListenAddrInUse(err) {
+			return ln, err
+		}
+
+		s.log(logger.Warn, "unable to listen on %s, retrying in %v: %s", address, interval, err)
+
+		select {
+		case <-time.After(interval):
+		case <-s.ctx.Done():
+			return nil, err
+		}
+
+		interval *= 2
+	}
+}
+
+func (s *rtmpServer) closeListeners() {
+	for _, ln := range s.lns {
+		ln.Close()
+	}
+}
+
+func (s *rtmpServer) listenAddresses() []string {
+	out := make([]string, len(s.lns))
+	for i, ln := range s.lns {
+		out[i] = ln.Addr().String()
+	}
+	return out
+}
+
+// acceptConn wraps an accepted connection with TLS, if needed, and passes it to run().
+func (s *rtmpServer) acceptConn(conn net.Conn, connNew chan net.Conn) {
+	if s.isTLS {
+		conn = tls.Server(conn, &tls.Config{GetCertificate: s.getCertificate})
+	}
+
+	select {
+	case connNew <- conn:
+	case <-s.ctx.Done():
+		conn.Close()
+	}
+}
+
+// acceptProxyConn reads the PROXY protocol header of an accepted connection,
+// in order to recover the address of the client.
+func (s *rtmpServer) acceptProxyConn(conn net.Conn, connNew chan net.Conn) {
+	defer s.wg.Done()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-done:
+		case <-s.ctx.Done():
+			conn.Close()
+		}
+	}()
+
+	pconn, err := newRTMPProxyConn(conn)
+	if err != nil {
+		s.log(logger.Warn, "connection refused: unable to read PROXY header from %v: %s",
+			conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	s.acceptConn(pconn, connNew)
+}
+
+// setTCPOptions applies the configured socket options to a connection.
+func (s *rtmpServer) setTCPOptions(nconn net.Conn) {
+	if pconn, ok := nconn.(*rtmpProxyConn); ok {
+		nconn = pconn.Conn
+	}
+
+	tconn, ok := nconn.(*net.TCPConn)
+	if !ok {
+		// TCP_NODELAY is enabled by default, warn only when other options are set.
+		if s.tcpReadBufferSize != 0 || s.tcpWriteBufferSize != 0 || s.tcpLinger != 0 {
+			s.log(logger.Warn, "unable to set TCP options: unsupported connection type %T", nconn)
+		}
+		return
+	}
+
+	err := tconn.SetNoDelay(!s.tcpNoDelayDisable)
+	if err != nil {
+		s.log(logger.Warn, "unable to set TCP_NODELAY: %s", err)
+	}
+
+	if s.tcpLinger != 0 {
+		err := tconn.SetLinger(int(time.Duration(s.tcpLinger).Seconds()))
+		if err != nil {
+			s.log(logger.Warn, "unable to set TCP linger: %s", err)
+		}
+	}
+
+	if s.tcpReadBufferSize != 0 {
+		err := tconn.SetReadBuffer(s.tcpReadBufferSize)
+		if err != nil {
+			s.log(logger.Warn, "unable to set TCP read buffer size: %s", err)
+		}
+	}
+
+	if s.tcpWriteBufferSize != 0 {
+		err := tconn.SetWriteBuffer(s.tcpWriteBufferSize)
+		if err != nil {
+			s.log(logger.Warn, "unable to set TCP write buffer size: %s", err)
+		}
+	}
+}
+
+func (s *rtmpServer) connIsSlow(c *rtmpConn) bool {
+	return s.slowWriteThreshold != 0 && c.writeDuration() > time.Duration(s.slowWriteThreshold)
+}
+
+// checkConns closes connections that have been idle or slow for too long.
+func (s *rtmpServer) checkConns(now time.Time) {
+	for c := range s.slowSince {
+		if _, ok := s.conns[c]; !ok {
+			delete(s.slowSince, c)
+		}
+	}
+
+	for c := range s.conns {
+		state, since := c.safeStateSince()
+
+		if s.idleTimeout != 0 && state == rtmpConnStateIdle &&
+			now.Sub(since) >= time.Duration(s.idleTimeout) {
+			c.log(logger.Info, "closing idle connection")
+			s.deleteConn(c)
+			c.closeWithReason(rtmpConnCloseReasonTimeout)
+			continue
+		}
+
+		if s.slowReaderKickAfter != 0 && state == rtmpConnStateRead {
+			if !s.connIsSlow(c) {
+				delete(s.slowSince, c)
+				continue
+			}
+
+			slowSince, ok := s.slowSince[c]
+			if !ok {
+				s.slowSince[c] = now
+				continue
+			}
+
+			if now.Sub(slowSince) >= time.Duration(s.slowReaderKickAfter) {
+				c.log(logger.Warn, "closing slow reader (average write duration: %v)", c.writeDuration())
+				s.deleteConn(c)
+				delete(s.slowSince, c)
+				c.closeWithReason(rtmpConnCloseReasonKicked)
+			}
+		}
+	}
+}
+
+// pathStatsAdd attaches a connection to the statistics of its path,
+// once the connection has a path.
+func (s *rtmpServer) pathStatsAdd(c *rtmpConn) {
+	if _, ok := s.connPaths[c]; ok {
+		return
+	}
+
+	path := c.safePathName()
+	if path == "" {
+		return
+	}
+
+	s.connPaths[c] = path
+
+	st, ok := s.pathStats[path]
+	if !ok {
+		st = &rtmpServerPathStats{}
+		s.pathStats[path] = st
+	}
+	st.conns++
+}
+
+// pathStatsRemove moves the bytes of a closed connection into the statistics of its path.
+// Statistics are dropped when the path has no connections left, in order not to
+// keep an entry for every path ever used.
+func (s *rtmpServer) pathStatsRemove(c *rtmpConn) {
+	path, ok := s.connPaths[c]
+	if !ok {
+		return
+	}
+	delete(s.connPaths, c)
+
+	st := s.pathStats[path]
+	st.conns--
+	if st.conns == 0 {
+		delete(s.pathStats, path)
+		return
+	}
+
+	st.bytesReceived += c.bytesReceived()
+	st.bytesSent += c.bytesSent()
+}
+
+// rtmpServerAcceptErrTemporary returns whether an accept error is expected to clear by itself.
+func rtmpServerAcceptErrTemporary(err error) bool {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		return true
+	}
+
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Temporary() //nolint:staticcheck
+}
+
+// rtmpServerAPIConnState returns the state of a connection as exposed by the API.
+func rtmpServerAPIConnState(state rtmpConnState) string {
+	switch state {
+	case rtmpConnStateRead:
+		return "read"
+
+	case rtmpConnStatePublish:
+		return "publish"
+
+	case rtmpConnStateAuth:
+		return "auth"
+
+	case rtmpConnStateMonitor:
+		return "monitor"
+	}
+	return "idle"
+}
+
+// publishConnEvent sends an event to subscribers.
+// Subscribers that are not able to keep up are dropped.
+func (s *rtmpServer) publishConnEvent(c *rtmpConn, state string) {
+	ev := rtmpServerAPIConnsEvent{
+		ID:         c.id,
+		RemoteAddr: c.remoteAddr().String(),
+		State:      state,
+	}
+
+	if state == "closed" {
+		ev.Reason = c.safeCloseReason()
+	}
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			s.log(logger.Warn, "events subscriber is too slow, dropping it")
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// rtmpServerAPIConnsListPaginate removes from items the entries that do not belong
+// to the given page, with entries sorted by ID, and returns the page count.
+func rtmpServerAPIConnsListPaginate(
+	items map[string]rtmpServerAPIConnsListItem,
+	page int,
+	itemsPerPage int,
+) int {
+	if itemsPerPage == 0 {
+		if len(items) == 0 {
+			return 0
+		}
+		return 1
+	}
+
+	ids := make([]string, 0, len(items))
+	for id := range items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	start := page * itemsPerPage
+	end := start + itemsPerPage
+
+	for i, id := range ids {
+		if i < start || i >= end {
+			delete(items, id)
+		}
+	}
+
+	return (len(ids) + itemsPerPage - 1) / itemsPerPage
+}
+
+// rtmpServerAPIConnsListOrder returns the IDs of items sorted by creation time,
+// in order to allow clients to display them in a stable order.
+func rtmpServerAPIConnsListOrder(items map[string]rtmpServerAPIConnsListItem) []string {
+	ids := make([]string, 0, len(items))
+	for id := range items {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		ci := items[ids[i]].Created
+		cj := items[ids[j]].Created
+		if !ci.Equal(cj) {
+			return ci.Before(cj)
+		}
+		return ids[i] < ids[j]
+	})
+
+	return ids
+}
+
+// rtmpConnStateIsValid checks whether state can be used to filter the connections list.
+func rtmpConnStateIsValid(state string) bool {
+	switch state {
+	case "", "idle", "auth", "read", "publish", "monitor":
+		return true
+	}
+	return false
+}
+
+// rtmpServerAddrMatcher returns a function that matches remote addresses against
+// an exact IP:port pair, an IP (regardless of the port), a CIDR network
+// or a prefix followed by '*', like "192.168.1.*".
+func rtmpServerAddrMatcher(addr string) (func(net.Addr) bool, error) {
+	if strings.HasSuffix(addr, "*") {
+		// a bare '*' would match every connection.
+		prefix := addr[:len(addr)-1]
+		if prefix == "" || strings.Contains(prefix, "*") {
+			return nil, fmt.Errorf("%w: '%s'", rtmpServerErrInvalidAddr, addr)
+		}
+
+		return func(ra net.Addr) bool {
+			return strings.HasPrefix(ra.String(), prefix)
+		}, nil
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return func(ra net.Addr) bool {
+			return ra.String() == addr
+		}, nil
+	}
+
+	if ip := net.ParseIP(addr); ip != nil {
+		return func(ra net.Addr) bool {
+			return ra.(*net.TCPAddr).IP.Equal(ip)
+		}, nil
+	}
+
+	if _, ipnet, err := net.ParseCIDR(addr); err == nil {
+		return func(ra net.Addr) bool {
+			return ipnet.Contains(ra.(*net.TCPAddr).IP)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%w: '%s'", rtmpServerErrInvalidAddr, addr)
+}
+
+// rtmpServerConnIDGenerator returns the function that generates connection IDs
+// in the given format, prepending the given prefix.
+func rtmpServerConnIDGenerator(format conf.ConnIDFormat, prefix string) func() (string, error) {
+	gen := rtmpServerConnIDFormatGenerator(format)
+	if prefix == "" {
+		return gen
+	}
+
+	return func() (string, error) {
+		id, err := gen()
+		if err != nil {
+			return "", err
+		}
+		return prefix + id, nil
+	}
+}
+
+func rtmpServerConnIDFormatGenerator(format conf.ConnIDFormat) func() (string, error) {
+	switch format {
+	case conf.ConnIDFormatUUID:
+		return func() (string, error) {
+			b := make([]byte, 16)
+			_, err := rand.Read(b)
+			if err != nil {
+				return "", err
+			}
+
+			b[6] = (b[6] & 0x0f) | 0x40 // version 4
+			b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+
+			return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+		}
+
+	case conf.ConnIDFormatHex:
+		return func() (string, error) {
+			b := make([]byte, 8)
+			_, err := rand.Read(b)
+			if err != nil {
+				return "", err
+			}
+
+			return hex.EncodeToString(b), nil
+		}
+
+	default:
+		return func() (string, error) {
+			b := make([]byte, 8)
+			_, err := rand.Read(b)
+			if err != nil {
+				return "", err
+			}
+
+			u := binary.LittleEndian.Uint64(b)
+			u %= 900000000000000000
+			u += 100000000000000000
+
+			return strconv.FormatUint(u, 10), nil
+		}
+	}
+}
+
+// deleteConn removes a connection from the connection maps.
+func (s *rtmpServer) deleteConn(c *rtmpConn) {
+	delete(s.conns, c)
+	delete(s.connsByID, c.id)
+}
+
+func (s *rtmpServer) newConnID() (string, error) {
+	for {
+		id, err := s.connIDGenerator()
+		if err != nil {
+			return "", err
+		}
+
+		if _, ok := s.connsByID[id]; !ok {
+			return id, nil
+		}
+	}
+}
+
+// ipAllowed checks whether ip is allowed to connect. Denied networks
+// take precedence over allowed ones, and an empty allow list allows all IPs.
+func (s *rtmpServer) ipAllowed(ip net.IP) bool {
+	if ipEqualOrInRange(ip, s.deniedNets) {
+		return false
+	}
+
+	return len(s.allowedNets) == 0 || ipEqualOrInRange(ip, s.allowedNets)
+}
+
+// connRateExceeded records a new connection from ip and reports whether ip
+// has opened more than connRateLimit connections within connRateWindow.
+func (s *rtmpServer) connRateExceeded(ip string, now time.Time) bool {
+	if s.connRateLimit == 0 {
+		return false
+	}
+
+	times := s.connRates[ip]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= time.Duration(s.connRateWindow) {
+		i++
+	}
+	times = append(times[i:], now)
+	s.connRates[ip] = times
+
+	return len(times) > s.connRateLimit
+}
+
+// loadCertificate loads the server certificate, if its files have changed since the last load.
+func (s *rtmpServer) loadCertificate() error {
+	certStat, err := os.Stat(s.serverCert)
+	if err != nil {
+		return err
+	}
+
+	keyStat, err := os.Stat(s.serverKey)
+	if err != nil {
+		return err
+	}
+
+	s.certMutex.Lock()
+	defer s.certMutex.Unlock()
+
+	if s.cert != nil &&
+		certStat.ModTime().Equal(s.certModTime) &&
+		keyStat.ModTime().Equal(s.keyModTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.serverCert, s.serverKey)
+	if err != nil {
+		return err
+	}
+
+	if s.cert != nil {
+		s.log(logger.Info, "server certificate reloaded")
+	}
+
+	s.cert = &cert
+	s.certModTime = certStat.ModTime()
+	s.keyModTime = keyStat.ModTime()
+
+	return nil
+}
+
+// checkCertificate reloads the server certificate if its files have changed.
+// When the reload fails, the previous certificate is kept and the error is logged
+// once, until a reload succeeds.
+func (s *rtmpServer) checkCertificate() {
+	err := s.loadCertificate()
+	if err != nil {
+		if !s.certReloadFailed {
+			s.certReloadFailed = true
+			s.log(logger.Warn, "unable to reload server certificate: %s", err)
+		}
+		return
+	}
+
+	s.certReloadFailed = false
+}
+
+// getCertificate is called by the TLS listener during every handshake.
+// The certificate is reloaded periodically by run(), in order to keep file I/O
+// out of the handshake.
+func (s *rtmpServer) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.certMutex.Lock()
+	defer s.certMutex.Unlock()
+	return s.cert, nil
+}
+
+// confReload is called by core.
+func (s *rtmpServer) confReload(req rtmpServerConfReloadReq) {
+	select {
+	case s.chConfReload <- req:
+	case <-s.ctx.Done():
+	}
+}
+
+// handshakeDurations is called by metrics.
+func (s *rtmpServer) handshakeDurations() *metricsHistogram {
+	return s.handshakeHistogram
+}
+
+// pathsStats is called by metrics.
+func (s *rtmpServer) pathsStats() map[string]rtmpServerPathStats {
+	req := make(chan rtmpServerPathsStatsRes)
+	select {
+	case s.chPathsStats <- req:
+	case <-s.ctx.Done():
+		return nil
+	}
+
+	res := <-req
+
+	// bytes of open connections are added by the caller, in order not to block the loop.
+	out := res.closed
+	for c, path := range res.conns {
+		st := out[path]
+		st.bytesReceived += c.bytesReceived()
+		st.bytesSent += c.bytesSent()
+		out[path] = st
+	}
+
+	return out
+}
+
+// connsStats is called by metrics.
+func (s *rtmpServer) connsStats() rtmpServerConnsStats {
+	return rtmpServerConnsStats{
+		accepted:      atomic.LoadUint64(&s.connsAccepted),
+		kicked:        atomic.LoadUint64(&s.connsKicked),
+		refusedLimit:  atomic.LoadUint64(&s.connsRefusedLimit),
+		refusedDenied: atomic.LoadUint64(&s.connsRefusedDenied),
+		refusedRate:   atomic.LoadUint64(&s.connsRefusedRate),
+	}
+}
+
+// connsLimit is called by metrics.
+func (s *rtmpServer) connsLimit() int {
+	return s.maxConns
+}
+
+func (s *rtmpServer) setConnLogDisable(v bool) {
+	if v {
+		atomic.StoreInt32(&s.connLogDisable, 1)
+	} else {
+		atomic.StoreInt32(&s.connLogDisable, 0)
+	}
+}
+
+// connLogEnabled is called by rtmpConn.
+func (s *rtmpServer) connLogEnabled(level logger.Level) bool {
+	return level != logger.Info || atomic.LoadInt32(&s.connLogDisable) == 0
+}
+
+// connHandshakeDone is called by rtmpConn.
+func (s *rtmpServer) connHandshakeDone(d time.Duration) {
+	s.handshakeHistogram.observe(d)
+}
+
+// connStateChange is called by rtmpConn.
+func (s *rtmpServer) connStateChange(c *rtmpConn) {
+	select {
+	case s.chConnStateChange <- c:
+	case <-s.ctx.Done():
+	}
+}
+
+// connClose is called by rtmpConn.
+func (s *rtmpServer) connClose(c *rtmpConn) {
+	select {
+	case s.chConnClose <- c:
+	case <-s.ctx.Done():
+	}
+}
+
+// connPublish is called by rtmpConn.
+func (s *rtmpServer) connPublish(c *rtmpConn, pathName string) {
+	s.publishHooks.publish(pathName, c.id)
+}
+
+// connUnpublish is called by rtmpConn.
+func (s *rtmpServer) connUnpublish(c *rtmpConn, pathName string) {
+	s.publishHooks.unpublish(pathName, c.id)
+}
+
+// apiConnsList is called by api.
+func (s *rtmpServer) apiConnsList(req rtmpServerAPIConnsListReq) rtmpServerAPIConnsListRes {
+	req.res = make(chan rtmpServerAPIConnsListRes)
+	select {
+	case s.chAPIConnsList <- req:
+		res := <-req.res
+		return rtmpServerAPIConnsListRes{data: s.apiConnsListData(res.conns, req)}
+
+	case <-s.ctx.Done():
+		return rtmpServerAPIConnsListRes{err: rtmpServerErrTerminated}
+	}
+}
+
+// apiConnsGet is called by api.
+func (s *rtmpServer) apiConnsGet(req rtmpServerAPIConnsGetReq) rtmpServerAPIConnsGetRes {
+	req.res = make(chan rtmpServerAPIConnsGetRes)
+	select {
+	case s.chAPIConnsGet <- req:
 		return <-req.res
 
 	case <-s.ctx.Done():
-		return rtmpServerAPIConnsKickRes{err: fmt.Errorf("terminated")}
+		return rtmpServerAPIConnsGetRes{err: rtmpServerErrTerminated}
+	}
+}
+
+// apiConnsKick is called by api.
+func (s *rtmpServer) apiConnsKick(req rtmpServerAPIConnsKickReq) rtmpServerAPIConnsKickRes {
+	req.res = make(chan rtmpServerAPIConnsKickRes)
+	select {
+	case s.chAPIConnsKick <- req:
+		res := <-req.res
+		if res.err != nil || req.wait == 0 {
+			return res
+		}
+
+		// the connection is closed asynchronously, wait for its routine to exit.
+		t := time.NewTimer(req.wait)
+		defer t.Stop()
+
+		select {
+		case <-res.done:
+			return res
+
+		case <-t.C:
+			return rtmpServerAPIConnsKickRes{err: rtmpServerErrKickTimeout}
+		}
+
+	case <-s.ctx.Done():
+		return rtmpServerAPIConnsKickRes{err: rtmpServerErrTerminated}
+	}
+}
+
+// apiConnsKickByAddr is called by api.
+func (s *rtmpServer) apiConnsKickByAddr(req rtmpServerAPIConnsKickByAddrReq) rtmpServerAPIConnsKickByAddrRes {
+	req.res = make(chan rtmpServerAPIConnsKickByAddrRes)
+	select {
+	case s.chAPIConnsKickByAddr <- req:
+		return <-req.res
+
+	case <-s.ctx.Done():
+		return rtmpServerAPIConnsKickByAddrRes{err: rtmpServerErrTerminated}
+	}
+}
+
+// apiConnsKickIdle is called by api.
+func (s *rtmpServer) apiConnsKickIdle(req rtmpServerAPIConnsKickIdleReq) rtmpServerAPIConnsKickIdleRes {
+	req.res = make(chan rtmpServerAPIConnsKickIdleRes)
+	select {
+	case s.chAPIConnsKickIdle <- req:
+		return <-req.res
+
+	case <-s.ctx.Done():
+		return rtmpServerAPIConnsKickIdleRes{err: rtmpServerErrTerminated}
+	}
+}
+
+// apiConnsSubscribe is called by api.
+func (s *rtmpServer) apiConnsSubscribe(req rtmpServerAPIConnsSubscribeReq) rtmpServerAPIConnsSubscribeRes {
+	req.res = make(chan rtmpServerAPIConnsSubscribeRes)
+	select {
+	case s.chAPIConnsSubscribe <- req:
+		return <-req.res
+
+	case <-s.ctx.Done():
+		return rtmpServerAPIConnsSubscribeRes{err: rtmpServerErrTerminated}
+	}
+}
+
+// apiConnsUnsubscribe is called by api.
+func (s *rtmpServer) apiConnsUnsubscribe(ch chan rtmpServerAPIConnsEvent) {
+	select {
+	case s.chAPIConnsUnsubscribe <- ch:
+	case <-s.ctx.Done():
+	}
+}
+
+// apiHealthy is called by api.
+// It reports whether the listener is accepting connections.
+func (s *rtmpServer) apiHealthy() bool {
+	return atomic.LoadInt32(&s.healthy) == 1
+}
+
+// apiServerInfo is called by api.
+func (s *rtmpServer) apiServerInfo(req rtmpServerAPIServerInfoReq) rtmpServerAPIServerInfoRes {
+	req.res = make(chan rtmpServerAPIServerInfoRes)
+	select {
+	case s.chAPIServerInfo <- req:
+		return <-req.res
+
+	case <-s.ctx.Done():
+		// the event loop is not running anymore; report why.
+		data := &rtmpServerAPIServerInfoData{
+			Addresses:   s.listenAddresses(),
+			TLS:         s.isTLS,
+			Started:     s.started,
+			ConnsServed: atomic.LoadUint64(&s.connsAccepted),
+			Routines:    s.wg.routines(),
+			OpenFDs:     rtmpOpenFDs(),
+		}
+
+		s.acceptErrMutex.Lock()
+		if s.acceptErr != nil {
+			data.LastAcceptError = s.acceptErr.Error()
+		}
+		s.acceptErrMutex.Unlock()
+
+		return rtmpServerAPIServerInfoRes{data: data}
 	}
 }
@@ -1,18 +1,31 @@
 package core //nolint:dupl
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/aler9/gortsplib"
 	"github.com/aler9/gortsplib/pkg/mpeg4audio"
+	"github.com/notedit/rtmp/format/flv"
 	"github.com/notedit/rtmp/format/flv/flvio"
 	"github.com/stretchr/testify/require"
 
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+	"github.com/aler9/rtsp-simple-server/internal/logger"
 	"github.com/aler9/rtsp-simple-server/internal/rtmp"
 	"github.com/aler9/rtsp-simple-server/internal/rtmp/message"
 )
@@ -386,3 +399,936 @@ func TestRTMPServerAuthFail(t *testing.T) {
 		require.EqualError(t, err, "EOF")
 	})
 }
+
+func TestRTMPServerAddrMatcher(t *testing.T) {
+	ra := &net.TCPAddr{IP: net.ParseIP("192.168.1.5"), Port: 45678}
+
+	for _, ca := range []struct {
+		addr  string
+		match bool
+	}{
+		{"192.168.1.5:45678", true},
+		{"192.168.1.5:45679", false},
+		{"192.168.1.5", true},
+		{"192.168.1.6", false},
+		{"192.168.1.0/24", true},
+		{"192.168.2.0/24", false},
+		{"192.168.1.*", true},
+		{"192.168.1.5:4*", true},
+		{"192.168.10.*", false},
+	} {
+		t.Run(ca.addr, func(t *testing.T) {
+			match, err := rtmpServerAddrMatcher(ca.addr)
+			require.NoError(t, err)
+			require.Equal(t, ca.match, match(ra))
+		})
+	}
+
+	ra6 := &net.TCPAddr{IP: net.ParseIP("::1"), Port: 45678}
+	require.Equal(t, "[::1]:45678", ra6.String())
+
+	for _, addr := range []string{"[::1]:45678", "::1", "::/64"} {
+		match, err := rtmpServerAddrMatcher(addr)
+		require.NoError(t, err)
+		require.True(t, match(ra6))
+	}
+
+	match, err := rtmpServerAddrMatcher("[::1]:*")
+	require.NoError(t, err)
+	require.True(t, match(ra6))
+
+	for _, addr := range []string{"invalid", "*", "192.*.1.*", "192.168.1.*5"} {
+		_, err := rtmpServerAddrMatcher(addr)
+		require.ErrorIs(t, err, rtmpServerErrInvalidAddr)
+	}
+}
+
+func TestRTMPConnCloseReason(t *testing.T) {
+	for _, ca := range []struct {
+		name   string
+		err    error
+		reason string
+	}{
+		{"eof", io.EOF, rtmpConnCloseReasonNormal},
+		{"wrapped eof", fmt.Errorf("unable to read: %w", io.EOF), rtmpConnCloseReasonNormal},
+		{"timeout", os.ErrDeadlineExceeded, rtmpConnCloseReasonTimeout},
+		{"terminated", rtmpConnErrTerminated, rtmpConnCloseReasonTerminated},
+		{"wrapped terminated", fmt.Errorf("unable to read: %w", rtmpConnErrTerminated), rtmpConnCloseReasonTerminated},
+		{"bitrate exceeded", rtmpConnErrBitrateExceeded{bitrate: 2000, max: 1000}, rtmpConnCloseReasonBitrateExceeded},
+		{"error", errors.New("invalid chunk"), rtmpConnCloseReasonError},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			require.Equal(t, ca.reason, rtmpConnCloseReason(ca.err))
+		})
+	}
+
+	c := &rtmpConn{ctxCancel: func() {}}
+	c.closeWithReason(rtmpConnCloseReasonKicked)
+	require.Equal(t, rtmpConnCloseReasonKicked, c.setCloseReason(rtmpConnErrTerminated))
+}
+
+func TestRTMPConnBitrateMeter(t *testing.T) {
+	m := &rtmpConnBitrateMeter{window: 5 * time.Second}
+	start := time.Now()
+
+	// 1 Mbit/s
+	for i := 0; i < 5; i++ {
+		_, ok := m.sample(start.Add(time.Duration(i)*time.Second), uint64(i)*125000)
+		require.False(t, ok)
+	}
+
+	bitrate, ok := m.sample(start.Add(5*time.Second), 5*125000)
+	require.True(t, ok)
+	require.Equal(t, uint64(1000000), bitrate)
+
+	// 2 Mbit/s during the last 5 seconds
+	for i := 6; i <= 10; i++ {
+		bitrate, ok = m.sample(start.Add(time.Duration(i)*time.Second), 5*125000+uint64(i-5)*250000)
+		require.True(t, ok)
+	}
+	require.Equal(t, uint64(2000000), bitrate)
+	require.Len(t, m.samples, 6)
+}
+
+func TestRTMPServerPathStats(t *testing.T) {
+	s := &rtmpServer{
+		connPaths: make(map[*rtmpConn]string),
+		pathStats: make(map[string]*rtmpServerPathStats),
+	}
+
+	pa := &path{name: "mypath"}
+	c1 := &rtmpConn{path: pa, nconn: &rtmpConnNetConn{bytesReceived: 100, bytesSent: 10}}
+	c2 := &rtmpConn{path: pa, nconn: &rtmpConnNetConn{bytesReceived: 200, bytesSent: 20}}
+
+	s.pathStatsAdd(c1)
+	s.pathStatsAdd(c2)
+	s.pathStatsRemove(c1)
+	require.Equal(t, rtmpServerPathStats{conns: 1, bytesReceived: 100, bytesSent: 10}, *s.pathStats["mypath"])
+
+	// totals are dropped when the path has no connections left.
+	s.pathStatsRemove(c2)
+	require.NotContains(t, s.pathStats, "mypath")
+
+	c3 := &rtmpConn{path: pa, nconn: &rtmpConnNetConn{bytesReceived: 1, bytesSent: 1}}
+	s.pathStatsAdd(c3)
+	require.Equal(t, rtmpServerPathStats{conns: 1}, *s.pathStats["mypath"])
+	s.pathStatsRemove(c3)
+	require.Empty(t, s.pathStats)
+}
+
+func TestRTMPConnPathAllowed(t *testing.T) {
+	require.True(t, rtmpConnPathAllowed("any/path", nil))
+
+	allowed := conf.PathPatterns{"mystream", "live/*"}
+	require.True(t, rtmpConnPathAllowed("mystream", allowed))
+	require.True(t, rtmpConnPathAllowed("live/cam1", allowed))
+	require.False(t, rtmpConnPathAllowed("live/cam1/sub", allowed))
+	require.False(t, rtmpConnPathAllowed("other", allowed))
+}
+
+func TestRTMPConnLabels(t *testing.T) {
+	c := &rtmpConn{}
+
+	for _, line := range []string{
+		"starting",
+		"RTSP_LABEL customer=1234",
+		"RTSP_LABEL region = eu-west",
+		"RTSP_LABEL tier=gold",
+		"RTSP_LABEL =invalid",
+		"RTSP_LABEL invalid",
+		"RTSP_LABEL tier=",
+	} {
+		c.onConnectOutput(line)
+	}
+
+	require.Equal(t, map[string]string{
+		"customer": "1234",
+		"region":   "eu-west",
+	}, c.safeLabels())
+
+	require.Equal(t, map[string]string{}, (&rtmpConn{}).safeLabels())
+}
+
+func TestRTMPServerProxyProtocol(t *testing.T) {
+	for _, ca := range []struct {
+		name   string
+		header []byte
+		addr   string
+	}{
+		{
+			"v1 tcp4",
+			[]byte("PROXY TCP4 192.168.1.5 10.0.0.1 45678 1935\r\n"),
+			"192.168.1.5:45678",
+		},
+		{
+			"v1 tcp6",
+			[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 45678 1935\r\n"),
+			"[2001:db8::1]:45678",
+		},
+		{
+			"v1 unknown",
+			[]byte("PROXY UNKNOWN\r\n"),
+			"pipe",
+		},
+		{
+			"v2 tcp4",
+			append(append([]byte{}, rtmpProxyV2Signature...),
+				0x21, 0x11, 0x00, 0x0C,
+				192, 168, 1, 5,
+				10, 0, 0, 1,
+				0xB2, 0x6E,
+				0x07, 0x8F),
+			"192.168.1.5:45678",
+		},
+		{
+			"v2 local",
+			append(append([]byte{}, rtmpProxyV2Signature...),
+				0x20, 0x00, 0x00, 0x00),
+			"pipe",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			go client.Write(append(ca.header, []byte("data")...))
+
+			conn, err := newRTMPProxyConn(server)
+			require.NoError(t, err)
+			require.Equal(t, ca.addr, conn.RemoteAddr().String())
+
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(conn, buf)
+			require.NoError(t, err)
+			require.Equal(t, []byte("data"), buf)
+		})
+	}
+
+	t.Run("missing header", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		go client.Write([]byte("\x03\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"))
+
+		_, err := newRTMPProxyConn(server)
+		require.EqualError(t, err, "PROXY header not found")
+	})
+}
+
+type nilLogger struct{}
+
+func (nilLogger) LogComponent(logger.Level, string, string, ...interface{}) {}
+
+type countLogger struct {
+	warns int
+}
+
+func (l *countLogger) LogComponent(level logger.Level, _ string, _ string, _ ...interface{}) {
+	if level == logger.Warn {
+		l.warns++
+	}
+}
+
+func TestRTMPServerCheckCertificate(t *testing.T) {
+	l := &countLogger{}
+	s := &rtmpServer{
+		isTLS:      true,
+		serverCert: "/nonexisting/server.crt",
+		serverKey:  "/nonexisting/server.key",
+		parent:     l,
+	}
+
+	for i := 0; i < 3; i++ {
+		s.checkCertificate()
+	}
+	require.Equal(t, 1, l.warns)
+
+	serverCertFpath, err := writeTempFile(serverCert)
+	require.NoError(t, err)
+	defer os.Remove(serverCertFpath)
+
+	serverKeyFpath, err := writeTempFile(serverKey)
+	require.NoError(t, err)
+	defer os.Remove(serverKeyFpath)
+
+	s.serverCert = serverCertFpath
+	s.serverKey = serverKeyFpath
+	s.checkCertificate()
+	require.NotNil(t, s.cert)
+
+	// a new failure is logged once, and the previous certificate is kept.
+	cert := s.cert
+	s.serverCert = "/nonexisting/server.crt"
+	for i := 0; i < 3; i++ {
+		s.checkCertificate()
+	}
+	require.Equal(t, 2, l.warns)
+	require.Equal(t, cert, s.cert)
+
+	cert2, err := s.getCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, cert, cert2)
+}
+
+func TestRTMPServerListenRetry(t *testing.T) {
+	ln, err := rtmpListen("tcp4", "127.0.0.1:19351", false, 0)
+	require.NoError(t, err)
+
+	s := &rtmpServer{
+		ctx:                 context.Background(),
+		listenRetries:       3,
+		listenRetryInterval: conf.StringDuration(100 * time.Millisecond),
+		parent:              &nilLogger{},
+	}
+
+	_, err = rtmpListen("tcp4", "127.0.0.1:19351", false, 0)
+	require.Error(t, err)
+	require.True(t, rtmpListenAddrInUse(err))
+
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		ln.Close()
+	}()
+
+	ln2, err := s.listen("tcp4", "127.0.0.1:19351", false, 0)
+	require.NoError(t, err)
+	ln2.Close()
+}
+
+func TestRTMPServerAcceptErrTemporary(t *testing.T) {
+	require.True(t, rtmpServerAcceptErrTemporary(&net.OpError{
+		Op:  "accept",
+		Net: "tcp",
+		Err: os.NewSyscallError("accept4", syscall.EMFILE),
+	}))
+	require.False(t, rtmpServerAcceptErrTemporary(net.ErrClosed))
+}
+
+func TestRTMPServerConnRateExceeded(t *testing.T) {
+	s := &rtmpServer{
+		connRateLimit:  2,
+		connRateWindow: conf.StringDuration(10 * time.Second),
+		connRates:      make(map[string][]time.Time),
+	}
+
+	now := time.Now()
+	require.False(t, s.connRateExceeded("192.168.1.5", now))
+	require.False(t, s.connRateExceeded("192.168.1.5", now.Add(1*time.Second)))
+	require.True(t, s.connRateExceeded("192.168.1.5", now.Add(2*time.Second)))
+	require.False(t, s.connRateExceeded("192.168.1.6", now.Add(2*time.Second)))
+	require.False(t, s.connRateExceeded("192.168.1.5", now.Add(20*time.Second)))
+}
+
+func TestRTMPServerConnRateRefused(t *testing.T) {
+	p, ok := newInstance("rtspDisable: yes\n" +
+		"hlsDisable: yes\n" +
+		"rtmpConnRateLimit: 1\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	for i := 0; i < 3; i++ {
+		nconn, err := net.Dial("tcp", "127.0.0.1:1935")
+		require.NoError(t, err)
+		defer nconn.Close()
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	stats := p.rtmpServer.connsStats()
+	require.Equal(t, uint64(1), stats.accepted)
+	require.Equal(t, uint64(2), stats.refusedRate)
+}
+
+func TestRTMPServerIPAllowed(t *testing.T) {
+	var allowed conf.IPsOrCIDRs
+	err := allowed.UnmarshalJSON([]byte(`["192.168.1.0/24"]`))
+	require.NoError(t, err)
+
+	var denied conf.IPsOrCIDRs
+	err = denied.UnmarshalJSON([]byte(`["192.168.1.6"]`))
+	require.NoError(t, err)
+
+	s := &rtmpServer{}
+	require.True(t, s.ipAllowed(net.ParseIP("10.0.0.1")))
+
+	s.allowedNets = allowed
+	s.deniedNets = denied
+	require.True(t, s.ipAllowed(net.ParseIP("192.168.1.5")))
+	require.False(t, s.ipAllowed(net.ParseIP("192.168.1.6")))
+	require.False(t, s.ipAllowed(net.ParseIP("10.0.0.1")))
+}
+
+func TestRTMPServerNewConnID(t *testing.T) {
+	ids := []string{"a", "a", "b"}
+	s := &rtmpServer{
+		connsByID: map[string]*rtmpConn{
+			"a": {id: "a"},
+		},
+		connIDGenerator: func() (string, error) {
+			id := ids[0]
+			ids = ids[1:]
+			return id, nil
+		},
+	}
+
+	id, err := s.newConnID()
+	require.NoError(t, err)
+	require.Equal(t, "b", id)
+
+	s.connIDGenerator = func() (string, error) {
+		return "", fmt.Errorf("entropy unavailable")
+	}
+	_, err = s.newConnID()
+	require.EqualError(t, err, "entropy unavailable")
+
+	for _, ca := range []struct {
+		name   string
+		format conf.ConnIDFormat
+		regexp string
+	}{
+		{"decimal", conf.ConnIDFormatDecimal, `^[1-9][0-9]{17}$`},
+		{"uuid", conf.ConnIDFormatUUID, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+		{"hex", conf.ConnIDFormatHex, `^[0-9a-f]{16}$`},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			id, err := rtmpServerConnIDGenerator(ca.format, "")()
+			require.NoError(t, err)
+			require.Regexp(t, ca.regexp, id)
+		})
+	}
+
+	id, err = rtmpServerConnIDGenerator(conf.ConnIDFormatHex, "node-1.")()
+	require.NoError(t, err)
+	require.Regexp(t, `^node-1\.[0-9a-f]{16}$`, id)
+}
+
+func TestRTMPServerAPIConnsKickWait(t *testing.T) {
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+
+	s := &rtmpServer{
+		ctx:            ctx,
+		chAPIConnsKick: make(chan rtmpServerAPIConnsKickReq),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for req := range s.chAPIConnsKick {
+			req.res <- rtmpServerAPIConnsKickRes{done: done}
+		}
+	}()
+	defer close(s.chAPIConnsKick)
+
+	res := s.apiConnsKick(rtmpServerAPIConnsKickReq{id: "a"})
+	require.NoError(t, res.err)
+
+	res = s.apiConnsKick(rtmpServerAPIConnsKickReq{id: "a", wait: 50 * time.Millisecond})
+	require.Equal(t, rtmpServerErrKickTimeout, res.err)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(done)
+	}()
+
+	res = s.apiConnsKick(rtmpServerAPIConnsKickReq{id: "a", wait: 5 * time.Second})
+	require.NoError(t, res.err)
+}
+
+func TestRTMPServerAPIConnsErrors(t *testing.T) {
+	p, ok := newInstance("api: yes\n" +
+		"rtspDisable: yes\n" +
+		"hlsDisable: yes\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	for _, ca := range []struct {
+		method string
+		path   string
+		err    string
+	}{
+		{http.MethodGet, "get/a", "bad status code: 404"},
+		{http.MethodPost, "kick/a", "bad status code: 404"},
+		{http.MethodPost, "kickbyaddr/10.0.0.1", "bad status code: 404"},
+		{http.MethodPost, "kickbyaddr/invalid", "bad status code: 400"},
+		{http.MethodPost, "kickbyaddr/*", "bad status code: 400"},
+	} {
+		t.Run(ca.path, func(t *testing.T) {
+			err := httpRequest(ca.method, "http://localhost:9997/v1/rtmpconns/"+ca.path, nil, nil)
+			require.EqualError(t, err, ca.err)
+		})
+	}
+
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	ctxCancel()
+	s := &rtmpServer{ctx: ctx}
+
+	for _, err := range []error{
+		s.apiConnsList(rtmpServerAPIConnsListReq{}).err,
+		s.apiConnsGet(rtmpServerAPIConnsGetReq{id: "a"}).err,
+		s.apiConnsKick(rtmpServerAPIConnsKickReq{id: "a"}).err,
+		s.apiConnsKickByAddr(rtmpServerAPIConnsKickByAddrReq{addr: "10.0.0.1"}).err,
+		s.apiConnsKickIdle(rtmpServerAPIConnsKickIdleReq{}).err,
+		s.apiConnsSubscribe(rtmpServerAPIConnsSubscribeReq{}).err,
+	} {
+		require.ErrorIs(t, err, rtmpServerErrTerminated)
+		require.Equal(t, http.StatusServiceUnavailable, rtmpConnsErrStatus(err))
+	}
+
+	// server info is still reported, in order to show why the server stopped.
+	info := s.apiServerInfo(rtmpServerAPIServerInfoReq{})
+	require.NoError(t, info.err)
+	require.NotNil(t, info.data)
+
+	require.Equal(t, http.StatusGatewayTimeout, rtmpConnsErrStatus(rtmpServerErrKickTimeout))
+}
+
+func TestRTMPServerWaitGroup(t *testing.T) {
+	var wg rtmpServerWaitGroup
+
+	release := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-release
+		}()
+	}
+	require.Equal(t, int64(3), wg.routines())
+
+	close(release)
+	wg.Wait()
+	require.Equal(t, int64(0), wg.routines())
+}
+
+func TestRTMPServerAPIConnsListPaginate(t *testing.T) {
+	newItems := func() map[string]rtmpServerAPIConnsListItem {
+		return map[string]rtmpServerAPIConnsListItem{
+			"100000003": {},
+			"100000001": {},
+			"100000005": {},
+			"100000002": {},
+			"100000004": {},
+		}
+	}
+
+	items := newItems()
+	require.Equal(t, 1, rtmpServerAPIConnsListPaginate(items, 0, 0))
+	require.Len(t, items, 5)
+
+	items = newItems()
+	require.Equal(t, 3, rtmpServerAPIConnsListPaginate(items, 1, 2))
+	require.Equal(t, map[string]rtmpServerAPIConnsListItem{
+		"100000003": {},
+		"100000004": {},
+	}, items)
+
+	items = newItems()
+	require.Equal(t, 3, rtmpServerAPIConnsListPaginate(items, 3, 2))
+	require.Len(t, items, 0)
+}
+
+func TestRTMPServerAPIConnsListOrder(t *testing.T) {
+	now := time.Now()
+
+	require.Equal(t, []string{}, rtmpServerAPIConnsListOrder(nil))
+
+	require.Equal(t, []string{"100000003", "100000001", "100000002"},
+		rtmpServerAPIConnsListOrder(map[string]rtmpServerAPIConnsListItem{
+			"100000001": {Created: now.Add(time.Second)},
+			"100000002": {Created: now.Add(time.Second)},
+			"100000003": {Created: now},
+		}))
+}
+
+func TestRTMPServerPublishTokenValidator(t *testing.T) {
+	require.Nil(t, newRTMPPublishTokenValidator(""))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Path  string `json:"path"`
+			Token string `json:"token"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&in)
+		if err != nil || in.Path != "mypath" || in.Token != "mytoken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}))
+	defer ts.Close()
+
+	v := newRTMPPublishTokenValidator(ts.URL)
+	require.NoError(t, v("mypath", "mytoken"))
+	require.EqualError(t, v("mypath", "wrongtoken"), "bad status code: 401")
+}
+
+func BenchmarkRTMPServerNewConnID(b *testing.B) {
+	s := &rtmpServer{
+		conns:           make(map[*rtmpConn]struct{}),
+		connsByID:       make(map[string]*rtmpConn),
+		connIDGenerator: rtmpServerConnIDGenerator(conf.ConnIDFormatDecimal, ""),
+	}
+
+	for i := 0; i < 50000; i++ {
+		id, err := s.newConnID()
+		require.NoError(b, err)
+		c := &rtmpConn{id: id}
+		s.conns[c] = struct{}{}
+		s.connsByID[id] = c
+	}
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		_, err := s.newConnID()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRTMPServerAPIConnsList(b *testing.B) {
+	s := &rtmpServer{
+		conns: make(map[*rtmpConn]struct{}),
+	}
+
+	for i := 0; i < 20000; i++ {
+		nconn, _ := net.Pipe()
+		defer nconn.Close()
+		c := &rtmpConn{
+			id:    strconv.FormatInt(int64(i), 10),
+			nconn: &rtmpConnNetConn{Conn: nconn},
+		}
+		s.conns[c] = struct{}{}
+	}
+
+	// time spent by the event loop, that blocks other requests.
+	b.Run("loop", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			s.connsSnapshot()
+		}
+	})
+
+	// time spent by the caller.
+	b.Run("caller", func(b *testing.B) {
+		conns := s.connsSnapshot()
+		b.ResetTimer()
+
+		for n := 0; n < b.N; n++ {
+			s.apiConnsListData(conns, rtmpServerAPIConnsListReq{itemsPerPage: 100})
+		}
+	})
+}
+
+func BenchmarkRTMPListenReusePort(b *testing.B) {
+	for _, count := range []int{1, 4} {
+		b.Run(strconv.FormatInt(int64(count), 10), func(b *testing.B) {
+			lns := make([]net.Listener, count)
+			for i := range lns {
+				ln, err := rtmpListen("tcp4", "127.0.0.1:19350", true, 0)
+				if err != nil {
+					b.Skip(err)
+				}
+				defer ln.Close()
+				lns[i] = ln
+
+				go func() {
+					for {
+						conn, err := ln.Accept()
+						if err != nil {
+							return
+						}
+						conn.Close()
+					}
+				}()
+			}
+
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					conn, err := net.Dial("tcp4", "127.0.0.1:19350")
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					conn.Close()
+				}
+			})
+		})
+	}
+}
+
+func TestRTMPPublishHooks(t *testing.T) {
+	events := make(chan string, 10)
+	hooks := newRTMPPublishHooks(
+		100*time.Millisecond,
+		func(pathName string, connID string) {
+			events <- "publish " + pathName + " " + connID
+		},
+		func(pathName string, connID string) {
+			events <- "unpublish " + pathName + " " + connID
+		})
+
+	hooks.publish("mypath", "1")
+	require.Equal(t, "publish mypath 1", <-events)
+
+	// a publisher that reconnects within the debounce doesn't trigger any hook.
+	hooks.unpublish("mypath", "1")
+	hooks.publish("mypath", "2")
+
+	hooks.unpublish("mypath", "2")
+	require.Equal(t, "unpublish mypath 2", <-events)
+
+	hooks.publish("mypath", "3")
+	require.Equal(t, "publish mypath 3", <-events)
+
+	// delayed hooks are run when closing.
+	hooks.unpublish("mypath", "3")
+	hooks.close()
+	require.Equal(t, "unpublish mypath 3", <-events)
+
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, 0, len(events))
+}
+
+func TestRTMPFallbackReader(t *testing.T) {
+	var buf bytes.Buffer
+	mux := flv.NewMuxer(&buf)
+	for _, tag := range []flvio.Tag{
+		{
+			Type:          flvio.TAG_VIDEO,
+			VideoFormat:   flvio.VIDEO_H264,
+			FrameType:     flvio.FRAME_KEY,
+			AVCPacketType: flvio.AVC_SEQHDR,
+			Data:          []byte{0x01, 0x02},
+		},
+		{
+			Type:          flvio.TAG_VIDEO,
+			VideoFormat:   flvio.VIDEO_H264,
+			FrameType:     flvio.FRAME_KEY,
+			AVCPacketType: flvio.AVC_NALU,
+			Data:          []byte{0x00, 0x00, 0x00, 0x01, 0x05},
+		},
+		{
+			Type:          flvio.TAG_AUDIO,
+			SoundFormat:   flvio.SOUND_AAC,
+			SoundRate:     flvio.SOUND_44Khz,
+			SoundSize:     flvio.SOUND_16BIT,
+			SoundType:     flvio.SOUND_STEREO,
+			AACPacketType: flvio.AAC_RAW,
+			Time:          20,
+			Data:          []byte{0x03, 0x04},
+		},
+		{
+			Type:        flvio.TAG_AUDIO,
+			SoundFormat: flvio.SOUND_MP3,
+			Time:        30,
+			Data:        []byte{0x05},
+		},
+		{
+			Type:          flvio.TAG_VIDEO,
+			VideoFormat:   flvio.VIDEO_H264,
+			FrameType:     flvio.FRAME_INTER,
+			AVCPacketType: flvio.AVC_NALU,
+			Time:          40,
+			CTime:         40,
+			Data:          []byte{0x00, 0x00, 0x00, 0x01, 0x01},
+		},
+	} {
+		require.NoError(t, mux.WriteTag(tag))
+	}
+
+	fpath, err := writeTempFile(buf.Bytes())
+	require.NoError(t, err)
+	defer os.Remove(fpath)
+
+	r, err := newRTMPFallbackReader(fpath)
+	require.NoError(t, err)
+	defer r.close()
+
+	// the MP3 tag is skipped, and the second loop follows the first one.
+	for _, loopStart := range []time.Duration{0, 80 * time.Millisecond} {
+		msg, dts, err := r.next()
+		require.NoError(t, err)
+		require.Equal(t, loopStart, dts)
+		require.Equal(t, &message.MsgVideo{
+			ChunkStreamID:   message.MsgVideoChunkStreamID,
+			MessageStreamID: 0x1000000,
+			IsKeyFrame:      true,
+			H264Type:        flvio.AVC_SEQHDR,
+			Payload:         []byte{0x01, 0x02},
+			DTS:             loopStart,
+		}, msg)
+
+		_, dts, err = r.next()
+		require.NoError(t, err)
+		require.Equal(t, loopStart, dts)
+
+		msg, dts, err = r.next()
+		require.NoError(t, err)
+		require.Equal(t, loopStart+20*time.Millisecond, dts)
+		require.Equal(t, &message.MsgAudio{
+			ChunkStreamID:   message.MsgAudioChunkStreamID,
+			MessageStreamID: 0x1000000,
+			Rate:            flvio.SOUND_44Khz,
+			Depth:           flvio.SOUND_16BIT,
+			Channels:        flvio.SOUND_STEREO,
+			AACType:         flvio.AAC_RAW,
+			Payload:         []byte{0x03, 0x04},
+			DTS:             loopStart + 20*time.Millisecond,
+		}, msg)
+
+		msg, dts, err = r.next()
+		require.NoError(t, err)
+		require.Equal(t, loopStart+40*time.Millisecond, dts)
+		require.Equal(t, 40*time.Millisecond, msg.(*message.MsgVideo).PTSDelta)
+	}
+
+	// a file without supported tags is refused instead of being looped forever.
+	empty, err := writeTempFile(nil)
+	require.NoError(t, err)
+	defer os.Remove(empty)
+
+	r2, err := newRTMPFallbackReader(empty)
+	require.NoError(t, err)
+	defer r2.close()
+
+	_, _, err = r2.next()
+	require.EqualError(t, err, "the file doesn't contain any H264 or AAC tag")
+}
+
+func TestRTMPConnReaderKeepalive(t *testing.T) {
+	c := &rtmpConn{
+		readerKeepalive: conf.StringDuration(50 * time.Millisecond),
+		readQueue:       make(chan *data, 1),
+	}
+	c.lastDataPulled = time.Now().UnixNano()
+
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+
+	start := time.Now()
+	go c.runReaderKeepalive(ctx)
+
+	require.Equal(t, rtmpConnKeepaliveData, <-c.readQueue)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// pings are not queued when the queue is full.
+	c.readQueue <- &data{}
+	time.Sleep(150 * time.Millisecond)
+	require.Equal(t, 1, len(c.readQueue))
+}
+
+func TestRTMPConnReliableSlowReader(t *testing.T) {
+	l := &countLogger{}
+	nconn, nconn2 := net.Pipe()
+	defer nconn.Close()
+	defer nconn2.Close()
+
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+
+	c := &rtmpConn{
+		writeTimeout:  conf.StringDuration(100 * time.Millisecond),
+		nconn:         &rtmpConnNetConn{Conn: nconn},
+		parent:        &rtmpServer{parent: l},
+		ctx:           ctx,
+		ctxCancel:     ctxCancel,
+		readQueue:     make(chan *data, 1),
+		readQueueDone: make(chan struct{}),
+	}
+
+	c.onReaderData(&data{})
+
+	// the publisher is blocked up to writeTimeout, then the reader is closed.
+	start := time.Now()
+	c.onReaderData(&data{})
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	require.Equal(t, 1, l.warns)
+	require.Equal(t, rtmpConnCloseReasonTimeout, c.safeCloseReason())
+
+	// once the reader is closed, the publisher is not blocked anymore.
+	start = time.Now()
+	c.onReaderData(&data{})
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestRTMPServerTimeoutsReload(t *testing.T) {
+	p, ok := newInstance("api: yes\n" +
+		"rtspDisable: yes\n" +
+		"hlsDisable: yes\n" +
+		"paths:\n" +
+		"  all:\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	u, err := url.Parse("rtmp://127.0.0.1:1935/teststream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+	conn := rtmp.NewConn(nconn)
+
+	err = conn.InitializeClient(u, true)
+	require.NoError(t, err)
+
+	videoTrack := &gortsplib.TrackH264{
+		PayloadType: 96,
+		SPS: []byte{
+			0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+			0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+			0x00, 0x03, 0x00, 0x3d, 0x08,
+		},
+		PPS: []byte{
+			0x68, 0xee, 0x3c, 0x80,
+		},
+	}
+
+	err = conn.WriteTracks(videoTrack, nil)
+	require.NoError(t, err)
+
+	time.Sleep(500 * time.Millisecond)
+
+	connIDs := func() []string {
+		var out struct {
+			Items map[string]interface{} `json:"items"`
+		}
+		err := httpRequest(http.MethodGet, "http://localhost:9997/v1/rtmpconns/list", nil, &out)
+		require.NoError(t, err)
+
+		var ids []string
+		for id := range out.Items {
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	before := connIDs()
+	require.Len(t, before, 1)
+
+	err = httpRequest(http.MethodPost, "http://localhost:9997/v1/config/set", map[string]interface{}{
+		"readTimeout":  "7s",
+		"writeTimeout": "7s",
+	}, nil)
+	require.NoError(t, err)
+
+	time.Sleep(500 * time.Millisecond)
+
+	require.Equal(t, before, connIDs())
+
+	// the publisher is still attached to the path.
+	nconn2, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn2.Close()
+	conn2 := rtmp.NewConn(nconn2)
+
+	err = conn2.InitializeClient(u, false)
+	require.NoError(t, err)
+
+	videoTrack2, _, err := conn2.ReadTracks()
+	require.NoError(t, err)
+	require.Equal(t, videoTrack.SPS, videoTrack2.SPS)
+}
@@ -1,12 +1,18 @@
 package externalcmd
 
 import (
+	"bytes"
+	"io"
+	"os"
 	"strings"
 	"time"
 )
 
 const (
 	restartPause = 5 * time.Second
+
+	// lines longer than this are discarded by lineWriter.
+	maxLineSize = 4096
 )
 
 // Environment is a Cmd environment.
@@ -14,11 +20,12 @@ type Environment map[string]string
 
 // Cmd is an external command.
 type Cmd struct {
-	pool    *Pool
-	cmdstr  string
-	restart bool
-	env     Environment
-	onExit  func(int)
+	pool     *Pool
+	cmdstr   string
+	restart  bool
+	env      Environment
+	onOutput func(string)
+	onExit   func(int)
 
 	// in
 	terminate chan struct{}
@@ -31,6 +38,20 @@ func NewCmd(
 	restart bool,
 	env Environment,
 	onExit func(int),
+) *Cmd {
+	return NewCmdWithOutput(pool, cmdstr, restart, env, nil, onExit)
+}
+
+// NewCmdWithOutput allocates a Cmd. onOutput is called with every line that the
+// command prints on its standard output, which is still forwarded to the standard
+// output of the server.
+func NewCmdWithOutput(
+	pool *Pool,
+	cmdstr string,
+	restart bool,
+	env Environment,
+	onOutput func(string),
+	onExit func(int),
 ) *Cmd {
 	for key, val := range env {
 		cmdstr = strings.ReplaceAll(cmdstr, "$"+key, val)
@@ -41,6 +62,7 @@ func NewCmd(
 		cmdstr:    cmdstr,
 		restart:   restart,
 		env:       env,
+		onOutput:  onOutput,
 		onExit:    onExit,
 		terminate: make(chan struct{}),
 	}
@@ -57,6 +79,40 @@ func (e *Cmd) Close() {
 	close(e.terminate)
 }
 
+func (e *Cmd) stdout() io.Writer {
+	if e.onOutput == nil {
+		return os.Stdout
+	}
+	return io.MultiWriter(os.Stdout, &lineWriter{onLine: e.onOutput})
+}
+
+// lineWriter is a io.Writer that splits the written data into lines.
+type lineWriter struct {
+	buf    []byte
+	onLine func(string)
+}
+
+// Write implements io.Writer.
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		w.onLine(strings.TrimSuffix(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+
+	if len(w.buf) > maxLineSize {
+		w.buf = nil
+	}
+
+	return len(p), nil
+}
+
 func (e *Cmd) run() {
 	defer e.pool.wg.Done()
 
@@ -23,7 +23,7 @@ func (e *Cmd) runInner() (int, bool) {
 		cmd.Env = append(cmd.Env, key+"="+val)
 	}
 
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = e.stdout()
 	cmd.Stderr = os.Stderr
 
 	err = cmd.Start()
@@ -2,6 +2,7 @@ package logger
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -22,6 +23,17 @@ const (
 	Error
 )
 
+// Format is a log format.
+type Format int
+
+const (
+	// FormatText writes log entries as plain text.
+	FormatText Format = iota
+
+	// FormatJSON writes log entries as JSON objects.
+	FormatJSON
+)
+
 // Destination is a log destination.
 type Destination int
 
@@ -39,6 +51,7 @@ const (
 // Logger is a log handler.
 type Logger struct {
 	level        Level
+	format       Format
 	destinations map[Destination]struct{}
 
 	mutex        sync.Mutex
@@ -50,9 +63,10 @@ type Logger struct {
 }
 
 // New allocates a log handler.
-func New(level Level, destinations map[Destination]struct{}, filePath string) (*Logger, error) {
+func New(level Level, format Format, destinations map[Destination]struct{}, filePath string) (*Logger, error) {
 	lh := &Logger{
 		level:        level,
+		format:       format,
 		destinations: destinations,
 	}
 
@@ -167,13 +181,62 @@ func writeLevel(buf *bytes.Buffer, level Level, doColor bool) {
 	buf.WriteByte(' ')
 }
 
-func writeContent(buf *bytes.Buffer, format string, args []interface{}) {
+func writeContent(buf *bytes.Buffer, component string, format string, args []interface{}) {
+	if component != "" {
+		buf.WriteString("[" + component + "] ")
+	}
 	buf.Write([]byte(fmt.Sprintf(format, args...)))
 	buf.WriteByte('\n')
 }
 
+func writeJSON(buf *bytes.Buffer, level Level, component string, format string, args []interface{}) {
+	entry := struct {
+		Time      string `json:"time"`
+		Level     string `json:"level"`
+		Component string `json:"component,omitempty"`
+		Message   string `json:"message"`
+	}{
+		Time:      time.Now().Format(time.RFC3339),
+		Component: component,
+		Message:   fmt.Sprintf(format, args...),
+	}
+
+	switch level {
+	case Debug:
+		entry.Level = "debug"
+	case Info:
+		entry.Level = "info"
+	case Warn:
+		entry.Level = "warn"
+	case Error:
+		entry.Level = "error"
+	}
+
+	json.NewEncoder(buf).Encode(entry)
+}
+
+func (lh *Logger) writeEntry(buf *bytes.Buffer, doColor bool, level Level,
+	component string, format string, args []interface{},
+) {
+	buf.Reset()
+
+	if lh.format == FormatJSON {
+		writeJSON(buf, level, component, format, args)
+		return
+	}
+
+	writeTime(buf, doColor)
+	writeLevel(buf, level, doColor)
+	writeContent(buf, component, format, args)
+}
+
 // Log writes a log entry.
 func (lh *Logger) Log(level Level, format string, args ...interface{}) {
+	lh.LogComponent(level, "", format, args...)
+}
+
+// LogComponent writes a log entry that belongs to the given component.
+func (lh *Logger) LogComponent(level Level, component string, format string, args ...interface{}) {
 	if level < lh.level {
 		return
 	}
@@ -182,26 +245,17 @@ func (lh *Logger) Log(level Level, format string, args ...interface{}) {
 	defer lh.mutex.Unlock()
 
 	if _, ok := lh.destinations[DestinationStdout]; ok {
-		lh.stdoutBuffer.Reset()
-		writeTime(&lh.stdoutBuffer, true)
-		writeLevel(&lh.stdoutBuffer, level, true)
-		writeContent(&lh.stdoutBuffer, format, args)
+		lh.writeEntry(&lh.stdoutBuffer, true, level, component, format, args)
 		os.Stdout.Write(lh.stdoutBuffer.Bytes())
 	}
 
 	if _, ok := lh.destinations[DestinationFile]; ok {
-		lh.fileBuffer.Reset()
-		writeTime(&lh.fileBuffer, false)
-		writeLevel(&lh.fileBuffer, level, false)
-		writeContent(&lh.fileBuffer, format, args)
+		lh.writeEntry(&lh.fileBuffer, false, level, component, format, args)
 		lh.file.Write(lh.fileBuffer.Bytes())
 	}
 
 	if _, ok := lh.destinations[DestinationSyslog]; ok {
-		lh.syslogBuffer.Reset()
-		writeTime(&lh.syslogBuffer, false)
-		writeLevel(&lh.syslogBuffer, level, false)
-		writeContent(&lh.syslogBuffer, format, args)
+		lh.writeEntry(&lh.syslogBuffer, false, level, component, format, args)
 		lh.syslog.Write(lh.syslogBuffer.Bytes())
 	}
 }
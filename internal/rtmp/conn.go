@@ -21,8 +21,34 @@ import (
 const (
 	codecH264 = 7
 	codecAAC  = 10
+
+	// maximum length of the app and of the stream key, query included.
+	maxPathPartLength = 1024
 )
 
+// video codecs that can be announced with enhanced RTMP.
+var enhancedVideoFourCCs = []string{"hvc1", "av01", "vp09"}
+
+func enhancedVideoFourCC(v interface{}) (string, bool) {
+	var fourCC string
+
+	switch vt := v.(type) {
+	case float64:
+		u := uint32(vt)
+		fourCC = string([]byte{byte(u >> 24), byte(u >> 16), byte(u >> 8), byte(u)})
+
+	case string:
+		fourCC = vt
+	}
+
+	for _, e := range enhancedVideoFourCCs {
+		if fourCC == e {
+			return fourCC, true
+		}
+	}
+	return "", false
+}
+
 func resultIsOK1(res *message.MsgCommandAMF0) bool {
 	if len(res.Arguments) < 2 {
 		return false
@@ -81,6 +107,60 @@ func getTcURL(u *url.URL) string {
 	return nu.String() + app
 }
 
+// validateTcURL checks the tcUrl sent by the client in the connect command.
+func validateTcURL(tcURL string) error {
+	tu, err := url.Parse(tcURL)
+	if err != nil {
+		return fmt.Errorf("invalid tcUrl '%s': %v", tcURL, err)
+	}
+
+	if tu.Scheme == "" {
+		return fmt.Errorf("invalid tcUrl '%s': scheme is missing", tcURL)
+	}
+
+	if tu.Host == "" {
+		return fmt.Errorf("invalid tcUrl '%s': host is missing", tcURL)
+	}
+
+	return nil
+}
+
+// validatePathPart checks the app or the stream key sent by the client.
+func validatePathPart(name string, v string) error {
+	if len(v) > maxPathPartLength {
+		return fmt.Errorf("%s is too long (%d bytes, maximum is %d)", name, len(v), maxPathPartLength)
+	}
+
+	// the query of the stream key is not part of the path.
+	if i := strings.IndexByte(v, '?'); i >= 0 {
+		v = v[:i]
+	}
+
+	for _, seg := range strings.Split(v, "/") {
+		if seg == ".." {
+			return fmt.Errorf("%s contains a '..' segment", name)
+		}
+	}
+
+	return nil
+}
+
+// validateStreamPath checks the app and the stream key before they are used
+// to build the URL of the stream. The app can be empty, since some clients
+// put the whole path into the stream key, but not together with the stream key.
+func validateStreamPath(app string, key string) error {
+	if strings.Trim(app, "/") == "" && strings.Trim(key, "/") == "" {
+		return fmt.Errorf("app and stream key are both empty")
+	}
+
+	err := validatePathPart("app", app)
+	if err != nil {
+		return err
+	}
+
+	return validatePathPart("stream key", key)
+}
+
 func createURL(tcurl, app, play string) (*url.URL, error) {
 	u, err := url.ParseRequestURI("/" + app + "/" + play)
 	if err != nil {
@@ -107,8 +187,9 @@ func createURL(tcurl, app, play string) (*url.URL, error) {
 
 // Conn is a RTMP connection.
 type Conn struct {
-	bc  *bytecounter.ReadWriter
-	mrw *message.ReadWriter
+	bc       *bytecounter.ReadWriter
+	mrw      *message.ReadWriter
+	flashVer string
 }
 
 // NewConn initializes a connection.
@@ -349,6 +430,20 @@ func (c *Conn) InitializeServer() (*url.URL, bool, error) {
 		}
 	}
 
+	c.flashVer, ok = ma.GetString("flashVer")
+	if !ok {
+		c.flashVer, _ = ma.GetString("flashver")
+	}
+
+	err = validateTcURL(tcURL)
+	if err == nil {
+		err = validatePathPart("app", connectpath)
+	}
+	if err != nil {
+		c.writeConnectRejected(cmd, err)
+		return nil, false, err
+	}
+
 	err = c.mrw.Write(&message.MsgSetWindowAckSize{
 		Value: 2500000,
 	})
@@ -425,6 +520,12 @@ func (c *Conn) InitializeServer() (*url.URL, bool, error) {
 				return nil, false, fmt.Errorf("invalid play command arguments")
 			}
 
+			err = validateStreamPath(connectpath, actionpath)
+			if err != nil {
+				c.writeStreamRejected(cmd, "NetStream.Play.Failed", err)
+				return nil, false, err
+			}
+
 			u, err := createURL(tcURL, connectpath, actionpath)
 			if err != nil {
 				return nil, false, err
@@ -528,6 +629,12 @@ func (c *Conn) InitializeServer() (*url.URL, bool, error) {
 				return nil, false, fmt.Errorf("invalid publish command arguments")
 			}
 
+			err = validateStreamPath(connectpath, actionpath)
+			if err != nil {
+				c.writeStreamRejected(cmd, "NetStream.Publish.BadName", err)
+				return nil, false, err
+			}
+
 			u, err := createURL(tcURL, connectpath, actionpath)
 			if err != nil {
 				return nil, false, err
@@ -556,6 +663,47 @@ func (c *Conn) InitializeServer() (*url.URL, bool, error) {
 	}
 }
 
+// writeConnectRejected tells the client why its connect command was refused.
+func (c *Conn) writeConnectRejected(cmd *message.MsgCommandAMF0, reason error) error {
+	return c.mrw.Write(&message.MsgCommandAMF0{
+		ChunkStreamID: cmd.ChunkStreamID,
+		Name:          "_error",
+		CommandID:     cmd.CommandID,
+		Arguments: []interface{}{
+			nil,
+			flvio.AMFMap{
+				{K: "level", V: "error"},
+				{K: "code", V: "NetConnection.Connect.Rejected"},
+				{K: "description", V: reason.Error()},
+			},
+		},
+	})
+}
+
+// writeStreamRejected tells the client why its play or publish command was refused.
+func (c *Conn) writeStreamRejected(cmd *message.MsgCommandAMF0, code string, reason error) error {
+	return c.mrw.Write(&message.MsgCommandAMF0{
+		ChunkStreamID:   5,
+		MessageStreamID: 0x1000000,
+		Name:            "onStatus",
+		CommandID:       cmd.CommandID,
+		Arguments: []interface{}{
+			nil,
+			flvio.AMFMap{
+				{K: "level", V: "error"},
+				{K: "code", V: code},
+				{K: "description", V: reason.Error()},
+			},
+		},
+	})
+}
+
+// FlashVer returns the client software sent by the client in the connect command.
+// It is empty when the client didn't provide it.
+func (c *Conn) FlashVer() string {
+	return c.flashVer
+}
+
 // ReadMessage reads a message.
 func (c *Conn) ReadMessage() (message.Message, error) {
 	return c.mrw.Read()
@@ -566,6 +714,25 @@ func (c *Conn) WriteMessage(msg message.Message) error {
 	return c.mrw.Write(msg)
 }
 
+// WriteReconnectRequest asks the client to reconnect to another server.
+// u is the URL of the stream on the other server.
+// Clients that do not support the request ignore it.
+func (c *Conn) WriteReconnectRequest(u *url.URL) error {
+	return c.mrw.Write(&message.MsgCommandAMF0{
+		ChunkStreamID: 3,
+		Name:          "onStatus",
+		Arguments: []interface{}{
+			nil,
+			flvio.AMFMap{
+				{K: "level", V: "status"},
+				{K: "code", V: "NetConnection.Connect.ReconnectRequest"},
+				{K: "description", V: "The streaming server is undergoing updates."},
+				{K: "tcUrl", V: getTcURL(u)},
+			},
+		},
+	})
+}
+
 func trackFromH264DecoderConfig(data []byte) (*gortsplib.TrackH264, error) {
 	var conf h264conf.Conf
 	err := conf.Unmarshal(data)
@@ -630,6 +797,10 @@ func (c *Conn) readTracksFromMetadata(payload []interface{}) (*gortsplib.TrackH2
 			}
 		}
 
+		if fourCC, ok := enhancedVideoFourCC(v); ok {
+			return false, fmt.Errorf("unsupported enhanced codec: %q", fourCC)
+		}
+
 		return false, fmt.Errorf("unsupported video codec %v", v)
 	}()
 	if err != nil {
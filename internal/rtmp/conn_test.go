@@ -272,6 +272,7 @@ func TestInitializeServer(t *testing.T) {
 					Path:   "//stream/",
 				}, u)
 				require.Equal(t, ca == "publish", isPublishing)
+				require.Equal(t, "LNX 9,0,124,2", conn.FlashVer())
 
 				close(done)
 			}()
@@ -1225,3 +1226,117 @@ func BenchmarkRead(b *testing.B) {
 		conn.ReadMessage()
 	}
 }
+
+func TestWriteReconnectRequest(t *testing.T) {
+	sconn, cconn := net.Pipe()
+	defer sconn.Close()
+	defer cconn.Close()
+
+	go func() {
+		u, _ := url.Parse("rtmp://10.0.0.2:1935/stream/key?token=abc")
+		err := NewConn(sconn).WriteReconnectRequest(u)
+		require.NoError(t, err)
+	}()
+
+	mrw := message.NewReadWriter(bytecounter.NewReadWriter(cconn), false)
+
+	msg, err := mrw.Read()
+	require.NoError(t, err)
+	require.Equal(t, &message.MsgCommandAMF0{
+		ChunkStreamID: 3,
+		Name:          "onStatus",
+		Arguments: []interface{}{
+			nil,
+			flvio.AMFMap{
+				{K: "level", V: "status"},
+				{K: "code", V: "NetConnection.Connect.ReconnectRequest"},
+				{K: "description", V: "The streaming server is undergoing updates."},
+				{K: "tcUrl", V: "rtmp://10.0.0.2:1935/stream"},
+			},
+		},
+	}, msg)
+}
+
+func TestValidateStreamPath(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		app  string
+		key  string
+		err  string
+	}{
+		{"app and key", "live", "mystream", ""},
+		{"app only", "mystream", "", ""},
+		{"key only", "", "mystream", ""},
+		{"key with query", "live", "mystream?token=a/../b", ""},
+		{"empty", "/", "", "app and stream key are both empty"},
+		{"app traversal", "live/..", "mystream", "app contains a '..' segment"},
+		{"key traversal", "live", "../mystream", "stream key contains a '..' segment"},
+		{
+			"key too long",
+			"live",
+			string(bytes.Repeat([]byte{'a'}, 1025)),
+			"stream key is too long (1025 bytes, maximum is 1024)",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			err := validateStreamPath(ca.app, ca.key)
+			if ca.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, ca.err)
+			}
+		})
+	}
+}
+
+func TestInitializeServerRejectConnect(t *testing.T) {
+	sconn, cconn := net.Pipe()
+	defer sconn.Close()
+	defer cconn.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		_, _, err := NewConn(sconn).InitializeServer()
+		require.EqualError(t, err, "invalid tcUrl '/stream': scheme is missing")
+	}()
+
+	bc := bytecounter.NewReadWriter(cconn)
+
+	err := handshake.DoClient(bc, false)
+	require.NoError(t, err)
+
+	mrw := message.NewReadWriter(bc, true)
+
+	err = mrw.Write(&message.MsgCommandAMF0{
+		ChunkStreamID: 3,
+		Name:          "connect",
+		CommandID:     1,
+		Arguments: []interface{}{
+			flvio.AMFMap{
+				{K: "app", V: "stream"},
+				{K: "tcUrl", V: "/stream"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	msg, err := mrw.Read()
+	require.NoError(t, err)
+	require.Equal(t, &message.MsgCommandAMF0{
+		ChunkStreamID: 3,
+		Name:          "_error",
+		CommandID:     1,
+		Arguments: []interface{}{
+			nil,
+			flvio.AMFMap{
+				{K: "level", V: "error"},
+				{K: "code", V: "NetConnection.Connect.Rejected"},
+				{K: "description", V: "invalid tcUrl '/stream': scheme is missing"},
+			},
+		},
+	}, msg)
+
+	<-done
+}
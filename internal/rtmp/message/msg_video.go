@@ -36,6 +36,12 @@ func (m *MsgVideo) Unmarshal(raw *rawmessage.Message) error {
 		return fmt.Errorf("invalid body size")
 	}
 
+	// in enhanced RTMP, the codec is identified by a FourCC
+	// that follows the first byte.
+	if (raw.Body[0] & 0x80) != 0 {
+		return fmt.Errorf("unsupported enhanced codec: %q", raw.Body[1:5])
+	}
+
 	m.IsKeyFrame = (raw.Body[0] >> 4) == flvio.FRAME_KEY
 
 	codec := raw.Body[0] & 0x0F
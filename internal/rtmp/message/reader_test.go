@@ -225,3 +225,13 @@ func TestReader(t *testing.T) {
 		})
 	}
 }
+
+func TestReaderEnhancedVideo(t *testing.T) {
+	r := NewReader(bytecounter.NewReader(bytes.NewReader([]byte{
+		0x6, 0x26, 0xcf, 0xae, 0x0, 0x0, 0x8, 0x9,
+		0x1, 0x0, 0x0, 0x0, 0x90, 'h', 'v', 'c',
+		'1', 0x1, 0x2, 0x3,
+	})), nil)
+	_, err := r.Read()
+	require.EqualError(t, err, `unsupported enhanced codec: "hvc1"`)
+}